@@ -2,19 +2,17 @@
 // Implementation of Prometheus Collector Interface for rctl_exporter
 // https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
 
-// +build freebsd
-
 package collector
 
 import (
-	"os"
 	"fmt"
+	"os"
 	"strconv"
-	"strings"
+	"sync"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/yo000/rctl_exporter/rctl"
-	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
@@ -22,18 +20,67 @@ var (
 )
 
 type Collector struct {
-	resmgr rctl.ResourceMgr
-	log    *logrus.Logger
-	up     *prometheus.Desc
+	resmgr      *rctl.ResourceMgr
+	log         *logrus.Logger
+	up          *prometheus.Desc
+	utilization *prometheus.Desc
+	retries     *prometheus.Desc
+	duration    *prometheus.Desc
+	lastRefresh *prometheus.Desc
+	jailInfo    *prometheus.Desc
+	userClass   *prometheus.Desc
+	success     *prometheus.Desc
+	errors      *prometheus.Desc
 	// ... declare some more descriptors here ...
+
+	// Protects options, which can be replaced while scrapes are running
+	mu      sync.RWMutex
+	options Options
+}
+
+// Options : What the collector exports, in addition to resources usage
+type Options struct {
+	Resources   []rctl.ResourceName // Resources exported, all when empty
+	NoCmdLine   bool                // Do not label process and proctree metrics with their command line
+	NoCaptures  bool                // Do not turn named capture groups of regexps into labels
+	LegacyNames bool                // Also export untyped metrics named as before units were added
+}
+
+// Returns true if metrics of the resource are exported
+func (o Options) exports(name rctl.ResourceName) bool {
+	if len(o.Resources) == 0 {
+		return true
+	}
+	for _, n := range o.Resources {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
 
 // instantiate a collector object
-func New(resmgr rctl.ResourceMgr, log *logrus.Logger) *Collector {
+func New(resmgr *rctl.ResourceMgr, log *logrus.Logger) *Collector {
 	pid := strconv.Itoa(os.Getpid())
 	return &Collector{
-		up:     prometheus.NewDesc("rctl_up", "Whether scraping rctl's metrics was successful", nil,
-				prometheus.Labels{"version": gVersion,"pid": pid}),
+		up: prometheus.NewDesc("rctl_up", "Whether scraping rctl's metrics was successful", nil,
+			prometheus.Labels{"version": gVersion, "pid": pid}),
+		utilization: prometheus.NewDesc("rctl_utilization_ratio", "Resource usage divided by the rctl limit set on it",
+			[]string{"subject", "id", "resource", "action"}, nil),
+		retries: prometheus.NewDesc("rctl_buffer_retries_total", "Number of rctl calls retried with a larger output buffer",
+			nil, nil),
+		duration: prometheus.NewDesc("rctl_collect_duration_seconds", "Time spent collecting a subject during last refresh",
+			[]string{"subject"}, nil),
+		lastRefresh: prometheus.NewDesc("rctl_last_refresh_timestamp_seconds", "Time of the last refresh of resources usage",
+			nil, nil),
+		jailInfo: prometheus.NewDesc("rctl_jail_info", "Jail parameters, value is always 1",
+			[]string{"jid", "name", "hostname", "path", "osrelease", "parent", "ip4", "ip6", "vnet"}, nil),
+		userClass: prometheus.NewDesc("rctl_user_loginclass_info", "Login class of the user in master.passwd, value is always 1",
+			[]string{"uid", "username", "class"}, nil),
+		success: prometheus.NewDesc("rctl_collector_success", "Whether the filter was collected without error during last refresh",
+			[]string{"subject", "filter"}, nil),
+		errors: prometheus.NewDesc("rctl_collector_errors_total", "Number of filters which failed to be collected, by error",
+			[]string{"subject", "errno"}, nil),
 		log:    log,
 		resmgr: resmgr,
 
@@ -42,10 +89,33 @@ func New(resmgr rctl.ResourceMgr, log *logrus.Logger) *Collector {
 	}
 }
 
+// SetOptions : Replaces collector options, next scrapes use them
+func (c *Collector) SetOptions(o Options) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.options = o
+}
+
+func (c *Collector) getOptions() Options {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.options
+}
+
 // Describe - called to get descriptors of the metrics provided by the collector.
 // A descriptor contains metadata about the metric, but not the actual value.
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.up
+	ch <- c.utilization
+	ch <- c.retries
+	ch <- c.duration
+	ch <- c.lastRefresh
+	ch <- c.jailInfo
+	ch <- c.userClass
+	ch <- c.success
+	ch <- c.errors
 	// ... describe other metrics ...
 }
 
@@ -56,113 +126,258 @@ func (c *Collector) collectFromResourceStruct(ch chan<- prometheus.Metric) error
 	// 2. Send metrics value with MustNewConstMetric(desc, type, value, labels, labels,...)
 
 	// Example of metric names :
-	// rctl_usage_process_cputime{pid="713", cmdline="/usr/local/sbin/libvirtd --daemon --pid-file=/var/run/libvirtd.pid"}
-	// rctl_usage_user_cputime{user="yo"}
-	// rctl_usage_loginclass{class="daemon"}
-	// rctl_usage_jail{jid="120", name="dovecot"}
-
-	c.resmgr.Refresh()
-
-	for _, resrcObj := range c.resmgr.Resources {
-		if resrcObj.ResourceType == rctl.RESRC_PROCESS {
-			rawresrces := resrcObj.RawResources
-			rawresrc := strings.Split(rawresrces, ",")
-			for _, resrc := range rawresrc {
-				s := strings.SplitN(resrc, "=", 2)
-				if len(s) == 2 {
-					d := prometheus.NewDesc("rctl_usage_process_"+s[0], "man rctl", []string{"pid", "name", "cmdline"}, nil)
-					if len(s[1]) > 0 && s[1] != "0" {
-						v, err := strconv.ParseFloat(s[1], 64)
-						//v, err := strconv.ParseInt(s[1], 10, 64)
-						if err != nil {
-							c.log.Error("Error parsing " + s[1] + ", value of " + s[0] + " into int : " + err.Error())
-							return err
-						}
-						ch <- prometheus.MustNewConstMetric(d, prometheus.UntypedValue, v, resrcObj.ResourceID, resrcObj.ProcessName, resrcObj.ProcessCmdLine)
-					} else {
-						ch <- prometheus.MustNewConstMetric(d, prometheus.UntypedValue, 0, resrcObj.ResourceID, resrcObj.ProcessName, resrcObj.ProcessCmdLine)
-					}
-				} else {
-					c.log.Error("resource format is incorrect : " + resrc)
-					return fmt.Errorf("Resource incorrect format : %s", resrc)
-				}
+	// rctl_usage_process_cputime_seconds_total{pid="713", cmdline="/usr/local/sbin/libvirtd --daemon --pid-file=/var/run/libvirtd.pid"}
+	// rctl_usage_user_cputime_seconds_total{user="yo"}
+	// rctl_usage_loginclass_maxproc{class="daemon"}
+	// rctl_usage_procgroup_cputime_seconds_total{group="postgres"}
+	// rctl_procgroup_num_procs{group="postgres"}
+	// rctl_usage_proctree_cputime_seconds_total{pid="713", name="nginx", cmdline="nginx: master process"}
+	// rctl_proctree_num_procs{pid="713", name="nginx", cmdline="nginx: master process"}
+	// rctl_loginclass_limit_maxproc{name="daemon"}
+	// rctl_user_loginclass_info{uid="80", username="www", class="daemon"} 1
+	// rctl_usage_jail_memoryuse_bytes{jid="120", name="dovecot", parent=""}
+	// rctl_usage_jail_rollup_memoryuse_bytes{jid="120", name="dovecot", parent=""}
+	// rctl_jail_info{jid="120", name="dovecot", hostname="mail.example.org", path="/jails/dovecot", ...} 1
+	// rctl_limit_jail_memoryuse_bytes{jid="120", name="dovecot", action="deny", per="jail"}
+	// rctl_utilization_ratio{subject="jail", id="dovecot", resource="memoryuse", action="deny"}
 
+	// Without background refresh, each scrape refreshes resources
+	var snap *rctl.Snapshot
+	if c.resmgr.RefreshInterval() == 0 {
+		snap, _ = c.resmgr.Refresh()
+	} else {
+		snap = c.resmgr.Snapshot()
+	}
+	if snap == nil {
+		return fmt.Errorf("resources were never refreshed")
+	}
+	opts := c.getOptions()
+
+	for _, resrcObj := range snap.Resources {
+		subject, labels, values := resourceLabels(snap, resrcObj, opts)
+		if len(subject) == 0 {
+			continue
+		}
+
+		for _, name := range resrcObj.ResourceNames() {
+			if !opts.exports(name) {
+				continue
 			}
-		} else if resrcObj.ResourceType == rctl.RESRC_USER {
-			rawresrces := resrcObj.RawResources
-			rawresrc := strings.Split(rawresrces, ",")
-			for _, resrc := range rawresrc {
-				s := strings.SplitN(resrc, "=", 2)
-				if len(s) == 2 {
-					d := prometheus.NewDesc("rctl_usage_user_"+s[0], "man rctl", []string{"uid", "username"}, nil)
-					if len(s[1]) > 0 && s[1] != "0" {
-						v, err := strconv.ParseFloat(s[1], 64)
-						//v, err := strconv.ParseInt(s[1], 10, 64)
-						if err != nil {
-							c.log.Error("Error parsing " + s[1] + ", value of " + s[0] + " into int : " + err.Error())
-							return err
-						}
-						ch <- prometheus.MustNewConstMetric(d, prometheus.UntypedValue, v, resrcObj.ResourceID, resrcObj.UserName)
-					} else {
-						ch <- prometheus.MustNewConstMetric(d, prometheus.UntypedValue, 0, resrcObj.ResourceID, resrcObj.UserName)
-					}
-				} else {
-					c.log.Error("resource format is incorrect : " + resrc)
-					return fmt.Errorf("Resource incorrect format : %s", resrc)
-				}
-			}
-		} else if resrcObj.ResourceType == rctl.RESRC_JAIL {
-			rawresrces := resrcObj.RawResources
-			rawresrc := strings.Split(rawresrces, ",")
-			for _, resrc := range rawresrc {
-				s := strings.SplitN(resrc, "=", 2)
-				if len(s) == 2 {
-					d := prometheus.NewDesc("rctl_usage_jail_"+s[0], "man rctl", []string{"jid", "name"}, nil)
-					if len(s[1]) > 0 && s[1] != "0" {
-						v, err := strconv.ParseFloat(s[1], 64)
-						//v, err := strconv.ParseInt(s[1], 10, 64)
-						if err != nil {
-							c.log.Error("Error parsing " + s[1] + ", value of " + s[0] + " into int : " + err.Error())
-							return err
-						}
-						ch <- prometheus.MustNewConstMetric(d, prometheus.UntypedValue, v, resrcObj.ResourceID, resrcObj.JailName)
-					} else {
-						ch <- prometheus.MustNewConstMetric(d, prometheus.UntypedValue, 0, resrcObj.ResourceID, resrcObj.JailName)
-					}
-				} else {
-					c.log.Error("resource format is incorrect : " + resrc)
-					return fmt.Errorf("Resource incorrect format : %s", resrc)
-				}
-			}
-		} else if resrcObj.ResourceType == rctl.RESRC_LOGINCLASS {
-			rawresrces := resrcObj.RawResources
-			rawresrc := strings.Split(rawresrces, ",")
-			for _, resrc := range rawresrc {
-				s := strings.SplitN(resrc, "=", 2)
-				if len(s) == 2 {
-					d := prometheus.NewDesc("rctl_usage_loginclass_"+s[0], "man rctl", []string{"name"}, nil)
-					if len(s[1]) > 0 && s[1] != "0" {
-						v, err := strconv.ParseFloat(s[1], 64)
-						//v, err := strconv.ParseInt(s[1], 10, 64)
-						if err != nil {
-							c.log.Error("Error parsing " + s[1] + ", value of " + s[0] + " into int : " + err.Error())
-							return err
-						}
-						ch <- prometheus.MustNewConstMetric(d, prometheus.UntypedValue, v, resrcObj.LoginClassName)
-					} else {
-						ch <- prometheus.MustNewConstMetric(d, prometheus.UntypedValue, 0, resrcObj.LoginClassName)
-					}
-				} else {
-					c.log.Error("resource format is incorrect : " + resrc)
-					return fmt.Errorf("Resource incorrect format : %s", resrc)
-				}
+			v := float64(resrcObj.Usage[name])
+			fqname, help, valueType := usageMetric(subject, name)
+			d := prometheus.NewDesc(fqname, help, labels, nil)
+			ch <- prometheus.MustNewConstMetric(d, valueType, v, values...)
+
+			if legacy := "rctl_usage_" + subject + "_" + string(name); opts.LegacyNames && legacy != fqname {
+				d := prometheus.NewDesc(legacy, "man rctl", labels, nil)
+				ch <- prometheus.MustNewConstMetric(d, prometheus.UntypedValue, v, values...)
 			}
 		}
+
+		c.collectLimits(ch, snap, resrcObj, opts)
+
+		c.collectLoginClass(ch, resrcObj, opts)
+
+		if resrcObj.ResourceType == rctl.RESRC_PROCGROUP || resrcObj.ResourceType == rctl.RESRC_PROCTREE {
+			// Labels depend on capture groups of process groups
+			d := prometheus.NewDesc("rctl_"+subject+"_num_procs", "Number of processes whose usage is summed", labels, nil)
+			ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(resrcObj.NumProcs), values...)
+		}
+
+		if resrcObj.ResourceType == rctl.RESRC_JAIL {
+			jl := resrcObj.JailParams
+			ch <- prometheus.MustNewConstMetric(c.jailInfo, prometheus.GaugeValue, 1, resrcObj.ResourceID, resrcObj.JailName,
+				jl.Hostname, jl.Path, jl.OSRelease, resrcObj.JailParent, jl.IP4, jl.IP6, jl.VNet)
+		}
+	}
+
+	for subject, d := range snap.Durations {
+		ch <- prometheus.MustNewConstMetric(c.duration, prometheus.GaugeValue, d.Seconds(), subject)
+	}
+	ch <- prometheus.MustNewConstMetric(c.lastRefresh, prometheus.GaugeValue, float64(snap.Time.UnixNano())/1e9)
+
+	for _, f := range snap.Filters {
+		success := 1.0
+		if f.Err != nil {
+			success = 0
+		}
+		ch <- prometheus.MustNewConstMetric(c.success, prometheus.GaugeValue, success, f.Subject, f.Filter)
+	}
+	for k, n := range snap.ErrCounts {
+		ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(n), k.Subject, k.Errno)
+	}
+
+	// Failing filters are reported by rctl_collector_success, rctl is only down when nothing could be collected
+	if snap.AllFailed() {
+		return snap.Err()
+	}
+	if c.resmgr.Stale() {
+		last := c.resmgr.LastSuccess()
+		c.log.Warn("Resources were not refreshed successfully since " + last.String())
+		return fmt.Errorf("resources not refreshed successfully since %s", last)
 	}
 
 	return nil
 }
 
+// Returns subject name, label names and label values identifying a resource in metrics
+func subjectLabels(resrcObj rctl.Resource, opts Options) (string, []string, []string) {
+	switch resrcObj.ResourceType {
+	case rctl.RESRC_PROCESS, rctl.RESRC_PROCTREE:
+		subject := "process"
+		if resrcObj.ResourceType == rctl.RESRC_PROCTREE {
+			subject = "proctree"
+		}
+		// Command lines are long and change with arguments, they can be left out to keep series small
+		if opts.NoCmdLine {
+			return subject, []string{"pid", "name"}, []string{resrcObj.ResourceID, resrcObj.ProcessName}
+		}
+		return subject, []string{"pid", "name", "cmdline"}, []string{resrcObj.ResourceID, resrcObj.ProcessName, resrcObj.ProcessCmdLine}
+	case rctl.RESRC_USER:
+		return "user", []string{"uid", "username"}, []string{resrcObj.ResourceID, resrcObj.UserName}
+	case rctl.RESRC_JAIL:
+		return "jail", []string{"jid", "name", "parent"}, []string{resrcObj.ResourceID, resrcObj.JailName, resrcObj.JailParent}
+	case rctl.RESRC_JAIL_ROLLUP:
+		return "jail_rollup", []string{"jid", "name", "parent"}, []string{resrcObj.ResourceID, resrcObj.JailName, resrcObj.JailParent}
+	case rctl.RESRC_LOGINCLASS:
+		return "loginclass", []string{"name"}, []string{resrcObj.LoginClassName}
+	case rctl.RESRC_PROCGROUP:
+		return "procgroup", []string{"group"}, []string{resrcObj.ProcGroupName}
+	}
+	return "", nil, nil
+}
+
+// Returns subjectLabels, followed by capture groups of the subject regexps :
+// rctl_usage_process_memoryuse{pid="713", name="java", cmdline="java -jar billing.jar", app="billing"}
+// All metrics of a subject get the same labels, capture groups missing from the regexp which matched are empty.
+func resourceLabels(snap *rctl.Snapshot, resrcObj rctl.Resource, opts Options) (string, []string, []string) {
+	subject, labels, values := subjectLabels(resrcObj, opts)
+	if opts.NoCaptures {
+		return subject, labels, values
+	}
+	for _, name := range snap.Labels[subject] {
+		labels = append(labels, name)
+		values = append(values, resrcObj.Captures[name])
+	}
+	return subject, labels, values
+}
+
+// Subjects whose usage is a sum over processes coming and going, so their cumulative usage drops when a process exits.
+// Jail rollups are read from the kernel, which keeps accounting usage of exited processes.
+var summedSubjects = map[string]bool{"procgroup": true, "proctree": true}
+
+// Returns name, help and type of the usage metric of a resource, suffixed by its unit as in
+// rctl_usage_jail_memoryuse_bytes. Cumulative resources are counters, as rctl_usage_jail_cputime_seconds_total,
+// except for summed subjects where they are gauges, as rctl_usage_procgroup_cputime_seconds.
+// Resources missing from rctl.KnownResources keep their rctl name, and are untyped.
+func usageMetric(subject string, name rctl.ResourceName) (string, string, prometheus.ValueType) {
+	fqname := "rctl_usage_" + subject + "_" + string(name)
+
+	ri, ok := rctl.LookupResource(name)
+	if !ok {
+		return fqname, "man rctl", prometheus.UntypedValue
+	}
+	if len(ri.Unit) > 0 {
+		fqname += "_" + ri.Unit
+	}
+	help := fmt.Sprintf("Usage of %s, rctl resource %s", ri.Description, name)
+	if ri.Kind == rctl.KIND_CUMULATIVE && !summedSubjects[subject] {
+		return fqname + "_total", help, prometheus.CounterValue
+	}
+
+	return fqname, help, prometheus.GaugeValue
+}
+
+// Returns name and help of the limit metric of a resource, suffixed by its unit as in rctl_limit_jail_memoryuse_bytes
+func limitMetric(prefix string, name rctl.ResourceName, setBy string, man string) (string, string) {
+	fqname := prefix + string(name)
+
+	ri, ok := rctl.LookupResource(name)
+	if !ok {
+		// Some login.conf limits, as filesize, are not rctl resources
+		if unit, _ := rctl.LoginResourceUnit(name); len(unit) > 0 {
+			fqname += "_" + unit
+		}
+		return fqname, "Limit " + setBy + ", man " + man
+	}
+	if len(ri.Unit) > 0 {
+		fqname += "_" + ri.Unit
+	}
+
+	return fqname, fmt.Sprintf("Limit on %s %s, rctl resource %s", ri.Description, setBy, name)
+}
+
+// Returns the subject-id of a resource, as used in rctl rules
+func subjectID(resrcObj rctl.Resource) string {
+	switch resrcObj.ResourceType {
+	case rctl.RESRC_JAIL, rctl.RESRC_JAIL_ROLLUP:
+		return resrcObj.JailName
+	case rctl.RESRC_LOGINCLASS:
+		return resrcObj.LoginClassName
+	}
+	return resrcObj.ResourceID
+}
+
+// Send configured limits of a resource, next to its usage :
+// rctl_limit_jail_memoryuse{jid="120", name="dovecot", action="deny", per="jail"}
+// Limits accounted on the resource subject also give its utilization :
+// rctl_utilization_ratio{subject="jail", id="dovecot", resource="memoryuse", action="deny"}
+func (c *Collector) collectLimits(ch chan<- prometheus.Metric, snap *rctl.Snapshot, resrcObj rctl.Resource, opts Options) {
+	subject, labels, values := resourceLabels(snap, resrcObj, opts)
+	if len(subject) == 0 {
+		return
+	}
+	labels = append(labels, "action", "per")
+
+	for _, l := range resrcObj.Limits {
+		if !opts.exports(rctl.ResourceName(l.Resource)) {
+			continue
+		}
+		lvalues := append(values[:len(values):len(values)], l.Action, l.PerSubject())
+		fqname, help := limitMetric("rctl_limit_"+subject+"_", rctl.ResourceName(l.Resource), "set with rctl", "rctl")
+		d := prometheus.NewDesc(fqname, help, labels, nil)
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(l.Amount), lvalues...)
+		if legacy := "rctl_limit_" + subject + "_" + l.Resource; opts.LegacyNames && legacy != fqname {
+			d := prometheus.NewDesc(legacy, "Limit set with rctl, man rctl", labels, nil)
+			ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(l.Amount), lvalues...)
+		}
+
+		// A jail limit per process can not be compared with the jail usage
+		if l.PerSubject() != subject || l.Amount <= 0 {
+			continue
+		}
+		if v, ok := resrcObj.Usage[rctl.ResourceName(l.Resource)]; ok {
+			ch <- prometheus.MustNewConstMetric(c.utilization, prometheus.GaugeValue, float64(v)/float64(l.Amount),
+				subject, subjectID(resrcObj), l.Resource, l.Action)
+		}
+	}
+}
+
+// Send login.conf limits of login classes, and the login class of users
+func (c *Collector) collectLoginClass(ch chan<- prometheus.Metric, resrcObj rctl.Resource, opts Options) {
+	switch resrcObj.ResourceType {
+	case rctl.RESRC_LOGINCLASS:
+		for name, v := range resrcObj.LoginClassLimits {
+			if !opts.exports(name) {
+				continue
+			}
+			fqname, help := limitMetric("rctl_loginclass_limit_", name, "set in login.conf", "login.conf")
+			d := prometheus.NewDesc(fqname, help, []string{"name"}, nil)
+			ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v), resrcObj.LoginClassName)
+			if legacy := "rctl_loginclass_limit_" + string(name); opts.LegacyNames && legacy != fqname {
+				d := prometheus.NewDesc(legacy, "Limit set in login.conf, man login.conf", []string{"name"}, nil)
+				ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v), resrcObj.LoginClassName)
+			}
+		}
+	case rctl.RESRC_USER:
+		// Class is only known when master.passwd could be read
+		if len(resrcObj.UserLoginClass) > 0 {
+			ch <- prometheus.MustNewConstMetric(c.userClass, prometheus.GaugeValue, 1, resrcObj.ResourceID, resrcObj.UserName,
+				resrcObj.UserLoginClass)
+		}
+	}
+}
+
 // Collect - called to get the metric values
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	err := c.collectFromResourceStruct(ch)
@@ -171,4 +386,5 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	} else {
 		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1)
 	}
+	ch <- prometheus.MustNewConstMetric(c.retries, prometheus.CounterValue, float64(rctl.BufferRetries()))
 }
@@ -0,0 +1,323 @@
+package collector
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/yo000/rctl_exporter/rctl"
+)
+
+func testSource() *rctl.FakeSource {
+	f := rctl.NewFakeSource()
+	f.JailList = []rctl.Jail{{Name: "www", Jid: 1}, {Name: "www.php", Jid: 2, Parent: 1}, {Name: "db", Jid: 3}}
+	f.Usage["jail:www"] = "cputime=12,memoryuse=1048576"
+	f.Usage["jail:www.php"] = "cputime=2,memoryuse=4096"
+	f.Usage["jail:db"] = "cputime=1,memoryuse=2097152"
+	f.Rules["jail:www"] = "jail:www:memoryuse:deny=2097152"
+	f.ProcessList = []rctl.Process{{Pid: 10, PPid: 1, Name: "java", CmdLine: "java -jar app.jar"},
+		{Pid: 11, PPid: 10, Name: "sh", CmdLine: "sh"}}
+	f.Usage["process:10"] = "cputime=5,memoryuse=100"
+	f.Usage["process:11"] = "cputime=1,memoryuse=10"
+	f.UserList = []rctl.User{{Name: "www", Uid: 80}}
+	f.Usage["user:80"] = "cputime=1"
+	return f
+}
+
+// Scrapes while the manager is refreshed and reconfigured, run with -race
+func TestConcurrentCollect(t *testing.T) {
+	log := logrus.New()
+	log.SetLevel(logrus.WarnLevel)
+	rm, err := rctl.NewResourceManager([]string{"jail:.*", "process:^java"}, testSource(), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(rm, log)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		run(func(int) {
+			if _, err := reg.Gather(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	run(func(int) { rm.Refresh() })
+	run(func(i int) {
+		filters := []string{"jail:.*", "process:^java"}
+		if i%2 == 0 {
+			filters = []string{"jail:^www", "proctree:^java", "user:.*"}
+		}
+		err := rm.Reconfigure(filters, func(m *rctl.ResourceMgr) {
+			m.Workers = 1 + i%4
+			m.Limits = i%3 != 0
+			m.JailRollup = i%2 == 0
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		c.SetOptions(Options{NoCmdLine: i%2 == 0, LegacyNames: i%3 == 0})
+	})
+	wg.Wait()
+}
+
+// Returns label values of series of family name, by value of label key
+func gatherLabels(t *testing.T, reg *prometheus.Registry, name string, key string) map[string]map[string]string {
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := make(map[string]map[string]string)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			series[labels[key]] = labels
+		}
+	}
+
+	return series
+}
+
+func TestJailParent(t *testing.T) {
+	log := logrus.New()
+	rm, err := rctl.NewResourceManager([]string{"jail:.*"}, testSource(), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(New(rm, log))
+
+	// Info and usage series agree on the parent jail name
+	for _, name := range []string{"rctl_jail_info", "rctl_usage_jail_memoryuse_bytes"} {
+		series := gatherLabels(t, reg, name, "name")
+		if len(series) != 3 {
+			t.Fatalf("%s : got %d series, want 3", name, len(series))
+		}
+		if p := series["www.php"]["parent"]; p != "www" {
+			t.Errorf("%s : got parent %q for www.php, want www", name, p)
+		}
+		if p := series["www"]["parent"]; p != "" {
+			t.Errorf("%s : got parent %q for www, want none", name, p)
+		}
+	}
+}
+
+func TestUsageMetric(t *testing.T) {
+	tests := []struct {
+		subject   string
+		name      rctl.ResourceName
+		fqname    string
+		valueType prometheus.ValueType
+	}{
+		{"jail", "memoryuse", "rctl_usage_jail_memoryuse_bytes", prometheus.GaugeValue},
+		{"jail", "cputime", "rctl_usage_jail_cputime_seconds_total", prometheus.CounterValue},
+		{"process", "cputime", "rctl_usage_process_cputime_seconds_total", prometheus.CounterValue},
+		{"user", "maxproc", "rctl_usage_user_maxproc", prometheus.GaugeValue},
+		// Sums drop when processes exit
+		{"procgroup", "cputime", "rctl_usage_procgroup_cputime_seconds", prometheus.GaugeValue},
+		{"proctree", "wallclock", "rctl_usage_proctree_wallclock_seconds", prometheus.GaugeValue},
+		{"jail_rollup", "cputime", "rctl_usage_jail_rollup_cputime_seconds_total", prometheus.CounterValue},
+		{"jail", "unknown", "rctl_usage_jail_unknown", prometheus.UntypedValue},
+	}
+
+	for _, tt := range tests {
+		fqname, _, valueType := usageMetric(tt.subject, tt.name)
+		if fqname != tt.fqname || valueType != tt.valueType {
+			t.Errorf("usageMetric(%s, %s) = %s (%v), want %s (%v)", tt.subject, tt.name, fqname, valueType,
+				tt.fqname, tt.valueType)
+		}
+	}
+}
+
+func TestLimitMetric(t *testing.T) {
+	tests := []struct {
+		prefix string
+		name   rctl.ResourceName
+		fqname string
+	}{
+		{"rctl_limit_jail_", "memoryuse", "rctl_limit_jail_memoryuse_bytes"},
+		{"rctl_limit_user_", "maxproc", "rctl_limit_user_maxproc"},
+		{"rctl_loginclass_limit_", "cputime", "rctl_loginclass_limit_cputime_seconds"},
+		// login.conf only limits
+		{"rctl_loginclass_limit_", "filesize", "rctl_loginclass_limit_filesize_bytes"},
+		{"rctl_loginclass_limit_", "sbsize", "rctl_loginclass_limit_sbsize_bytes"},
+		{"rctl_loginclass_limit_", "pipebuf", "rctl_loginclass_limit_pipebuf_bytes"},
+		{"rctl_loginclass_limit_", "kqueues", "rctl_loginclass_limit_kqueues"},
+		{"rctl_limit_jail_", "unknown", "rctl_limit_jail_unknown"},
+	}
+
+	for _, tt := range tests {
+		if fqname, _ := limitMetric(tt.prefix, tt.name, "set with rctl", "rctl"); fqname != tt.fqname {
+			t.Errorf("limitMetric(%s, %s) = %s, want %s", tt.prefix, tt.name, fqname, tt.fqname)
+		}
+	}
+}
+
+func TestCollectRefresh(t *testing.T) {
+	log := logrus.New()
+	rm, err := rctl.NewResourceManager([]string{"jail:.*"}, testSource(), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(New(rm, log))
+
+	// Without background refresh, each scrape refreshes
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	first := rm.Snapshot()
+	if first == nil {
+		t.Fatal("scrape did not refresh")
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if rm.Snapshot() == first {
+		t.Error("second scrape did not refresh")
+	}
+
+	// With background refresh, scrapes read the last snapshot
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rm.Start(ctx, time.Hour)
+	started := rm.Snapshot()
+	for i := 0; i < 2; i++ {
+		if _, err := reg.Gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rm.Snapshot() != started {
+		t.Error("scrape refreshed despite background refresh")
+	}
+	if up := gatherLabels(t, reg, "rctl_jail_info", "name"); len(up) != 3 {
+		t.Errorf("got %d jails from the snapshot, want 3", len(up))
+	}
+}
+
+func TestCaptureLimitLabels(t *testing.T) {
+	f := testSource()
+	f.Limits["process:10"] = "user:80:memoryuse:deny=1073741824"
+
+	// A capture named like a label of limit metrics would make them panic, it is rejected
+	log := logrus.New()
+	if _, err := rctl.NewResourceManager([]string{`process:-(?P<action>[a-z]+)`}, f, log); err == nil {
+		t.Fatal("want an error for capture group action")
+	}
+
+	rm, err := rctl.NewResourceManager([]string{`process:-(?P<option>[a-z]+)`, `proctree:^(?P<app>java)`}, f, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(New(rm, log))
+
+	limits := gatherLabels(t, reg, "rctl_limit_process_memoryuse_bytes", "pid")
+	if l := limits["10"]; l["option"] != "jar" || l["action"] != "deny" || l["per"] != "user" {
+		t.Errorf("got limit labels %v", l)
+	}
+	trees := gatherLabels(t, reg, "rctl_usage_proctree_memoryuse_bytes", "pid")
+	if l := trees["10"]; l["app"] != "java" {
+		t.Errorf("got proctree labels %v", l)
+	}
+}
+
+// Returns values of series of family name, by their labels joined
+func gatherValues(t *testing.T, reg *prometheus.Registry, name string) map[string]float64 {
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var labels []string
+			for _, lp := range m.GetLabel() {
+				labels = append(labels, lp.GetName()+"="+lp.GetValue())
+			}
+			v := m.GetGauge().GetValue() + m.GetCounter().GetValue()
+			values[strings.Join(labels, ",")] = v
+		}
+	}
+
+	return values
+}
+
+func TestCollectErrors(t *testing.T) {
+	f := testSource()
+	f.Errors["user:80"] = syscall.EPERM
+	// Exited processes are not errors
+	f.Errors["process:11"] = syscall.ESRCH
+
+	log := logrus.New()
+	rm, err := rctl.NewResourceManager([]string{"jail:.*", "user:.*", "process:."}, f, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(New(rm, log))
+
+	success := gatherValues(t, reg, "rctl_collector_success")
+	wantSuccess := map[string]float64{"filter=jail:.*,subject=jail": 1, "filter=user:.*,subject=user": 0,
+		"filter=process:.,subject=process": 1}
+	if !reflect.DeepEqual(success, wantSuccess) {
+		t.Errorf("got success %v, want %v", success, wantSuccess)
+	}
+	// Counted since start, each scrape refreshes
+	errs := gatherValues(t, reg, "rctl_collector_errors_total")
+	if want := map[string]float64{"errno=EPERM,subject=user": 2}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("got errors %v, want %v", errs, want)
+	}
+	if pids := gatherLabels(t, reg, "rctl_usage_process_memoryuse_bytes", "pid"); len(pids) != 1 {
+		t.Errorf("got processes %v, want only 10", pids)
+	}
+
+	// Up while a filter succeeds, down once all of them fail
+	up := func() float64 {
+		values := gatherValues(t, reg, "rctl_up")
+		if len(values) != 1 {
+			t.Fatalf("got rctl_up %v", values)
+		}
+		for _, v := range values {
+			return v
+		}
+		return -1
+	}
+	if v := up(); v != 1 {
+		t.Errorf("got rctl_up %v with a failing filter, want 1", v)
+	}
+	for _, k := range []string{"jail:www", "jail:www.php", "jail:db", "process:10"} {
+		f.Errors[k] = syscall.EPERM
+	}
+	if v := up(); v != 0 {
+		t.Errorf("got rctl_up %v with all filters failing, want 0", v)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2020, johan@nosd.in
+//
+// Exporter configuration file, an alternative to command line flags
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/yo000/rctl_exporter/rctl"
+	"gopkg.in/yaml.v3"
+)
+
+// Config : Exporter configuration, as read from the --config.file YAML file :
+//
+//	refresh_interval: 30s
+//	process:
+//	  include: ["jail=web01,exe=nginx", "^/usr/local/bin/java"]
+//	user:
+//	  include: [".*"]
+//	  exclude: ["^(root|toor)$"]
+//	  source: passwd
+//	  uid_min: 1000
+//	procgroups:
+//	  - name: postgres
+//	    exe: postgres
+//	resources: [cputime, memoryuse, pcpu]
+//	labels:
+//	  cmdline: false
+type Config struct {
+	RefreshInterval time.Duration     `yaml:"refresh_interval"` // Background refresh interval, 0 to refresh at each scrape
+	Workers         int               `yaml:"workers"`          // Number of concurrent rctl lookups
+	Limits          bool              `yaml:"limits"`           // Also export rctl rules applying to collected items
+	Filters         []string          `yaml:"filters"`          // Filters in --rctl.filter syntax, e.g. "process:^java"
+	Process         SubjectConfig     `yaml:"process"`
+	ProcTree        SubjectConfig     `yaml:"proctree"`
+	User            UserConfig        `yaml:"user"`
+	Jail            JailConfig        `yaml:"jail"`
+	LoginClass      SubjectConfig     `yaml:"loginclass"`
+	ProcGroups      []ProcGroupConfig `yaml:"procgroups"`
+	Resources       []string          `yaml:"resources"` // Resources exported, all when empty
+	Labels          LabelsConfig      `yaml:"labels"`
+	Compat          CompatConfig      `yaml:"compat"`
+}
+
+// SubjectConfig : Regexps or selectors of the items of a subject to collect, and of those to skip
+type SubjectConfig struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// UserConfig : Users to collect, and where they are enumerated from
+type UserConfig struct {
+	SubjectConfig `yaml:",inline"`
+	Source        string `yaml:"source"`  // One of rctl.USER_SOURCES
+	UidMin        int    `yaml:"uid_min"` // Do not collect users with a lower UID
+	UidMax        int    `yaml:"uid_max"` // Do not collect users with a greater UID, -1 for no limit
+}
+
+// JailConfig : Jails to collect
+type JailConfig struct {
+	SubjectConfig `yaml:",inline"`
+	Rollup        bool `yaml:"rollup"` // Also export usage of ancestors of collected jails, which includes all their children
+}
+
+// ProcGroupConfig : A named group of processes, matched on their binary name or their command line.
+// Exe and Cmdline are a value, or a regexp when prefixed by '~'.
+type ProcGroupConfig struct {
+	Name    string `yaml:"name"`
+	Exe     string `yaml:"exe"`
+	Cmdline string `yaml:"cmdline"`
+}
+
+// LabelsConfig : Optional labels of metrics
+type LabelsConfig struct {
+	Cmdline  bool `yaml:"cmdline"`  // Label process and proctree metrics with their command line
+	Captures bool `yaml:"captures"` // Turn named capture groups of regexps into labels
+}
+
+// CompatConfig : Compatibility with previous versions of the exporter
+type CompatConfig struct {
+	LegacyNames bool `yaml:"legacy_names"` // Also export metrics named without their unit, untyped
+}
+
+// Default : Returns the configuration used for settings missing from the file
+func Default() Config {
+	return Config{
+		Workers: rctl.DEFAULT_WORKERS,
+		Limits:  true,
+		User:    UserConfig{Source: rctl.USER_SOURCE_UTMPX, UidMax: -1},
+		Labels:  LabelsConfig{Cmdline: true, Captures: true},
+	}
+}
+
+// Load : Reads and validates a configuration file
+func Load(file string) (Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Default(), err
+	}
+
+	cfg, err := Parse(data)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %w", file, err)
+	}
+
+	return cfg, nil
+}
+
+// Parse : Parses and validates a YAML configuration. Unknown settings are errors, so typos are not silently ignored.
+func Parse(data []byte) (Config, error) {
+	cfg := Default()
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	// An empty file is the default configuration
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate : Returns an error listing all invalid settings, nil if the configuration is valid
+func (c Config) Validate() error {
+	var msgs []string
+	invalid := func(format string, a ...interface{}) {
+		msgs = append(msgs, fmt.Sprintf(format, a...))
+	}
+
+	if c.RefreshInterval < 0 {
+		invalid("refresh_interval: must not be negative, got %v", c.RefreshInterval)
+	}
+	if c.Workers < 1 {
+		invalid("workers: must be at least 1, got %d", c.Workers)
+	}
+
+	for i, f := range c.Filters {
+		if err := rctl.CheckFilter(f); err != nil {
+			invalid("filters[%d]: %v", i, err)
+		}
+	}
+	subjects := []struct {
+		name string
+		sc   SubjectConfig
+	}{
+		{"process", c.Process},
+		{"proctree", c.ProcTree},
+		{"user", c.User.SubjectConfig},
+		{"jail", c.Jail.SubjectConfig},
+		{"loginclass", c.LoginClass},
+	}
+	for _, s := range subjects {
+		for i, f := range s.sc.Include {
+			if err := rctl.CheckFilter(s.name + ":" + f); err != nil {
+				invalid("%s.include[%d]: %v", s.name, i, err)
+			}
+		}
+		for i, f := range s.sc.Exclude {
+			if err := rctl.CheckFilter("!" + s.name + ":" + f); err != nil {
+				invalid("%s.exclude[%d]: %v", s.name, i, err)
+			}
+		}
+	}
+
+	if !contains(rctl.USER_SOURCES, c.User.Source) {
+		invalid("user.source: unknown source %q, expected one of %s", c.User.Source, strings.Join(rctl.USER_SOURCES, ", "))
+	}
+	if c.User.UidMin < 0 {
+		invalid("user.uid_min: must not be negative, got %d", c.User.UidMin)
+	}
+	if c.User.UidMax < -1 || c.User.UidMax >= 0 && c.User.UidMax < c.User.UidMin {
+		invalid("user.uid_max: must be -1 or not lower than uid_min, got %d", c.User.UidMax)
+	}
+
+	for i, g := range c.ProcGroups {
+		if _, err := g.procGroup(); err != nil {
+			invalid("procgroups[%d]: %v", i, err)
+		}
+	}
+
+	for i, name := range c.Resources {
+		if _, ok := rctl.LookupResource(rctl.ResourceName(name)); !ok {
+			invalid("resources[%d]: unknown resource %q", i, name)
+		}
+	}
+
+	if len(msgs) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(msgs, "\n  "))
+	}
+	return nil
+}
+
+// AllFilters : Returns filters of all sections, in --rctl.filter syntax. Exclude filters are prefixed by '!'.
+func (c Config) AllFilters() []string {
+	filters := append([]string{}, c.Filters...)
+
+	add := func(subject string, sc SubjectConfig) {
+		for _, f := range sc.Include {
+			filters = append(filters, subject+":"+f)
+		}
+		for _, f := range sc.Exclude {
+			filters = append(filters, "!"+subject+":"+f)
+		}
+	}
+	add("process", c.Process)
+	add("proctree", c.ProcTree)
+	add("user", c.User.SubjectConfig)
+	add("jail", c.Jail.SubjectConfig)
+	add("loginclass", c.LoginClass)
+
+	return filters
+}
+
+// UserSelection : Returns where users are enumerated from
+func (c Config) UserSelection() rctl.UserSelection {
+	return rctl.UserSelection{Source: c.User.Source, UidMin: c.User.UidMin, UidMax: c.User.UidMax}
+}
+
+// ProcessGroups : Returns the process groups, an error for the first invalid one
+func (c Config) ProcessGroups() ([]rctl.ProcGroup, error) {
+	var groups []rctl.ProcGroup
+
+	for _, gc := range c.ProcGroups {
+		g, err := gc.procGroup()
+		if err != nil {
+			return groups, err
+		}
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
+
+// ResourceNames : Returns the exported resources, empty for all
+func (c Config) ResourceNames() []rctl.ResourceName {
+	var names []rctl.ResourceName
+
+	for _, name := range c.Resources {
+		names = append(names, rctl.ResourceName(name))
+	}
+
+	return names
+}
+
+func (g ProcGroupConfig) procGroup() (rctl.ProcGroup, error) {
+	switch {
+	case len(g.Exe) > 0 && len(g.Cmdline) > 0:
+		return rctl.ProcGroup{}, fmt.Errorf("group %q : exe and cmdline are exclusive", g.Name)
+	case len(g.Exe) > 0:
+		return newProcGroup(g.Name, "exe", g.Exe)
+	case len(g.Cmdline) > 0:
+		return newProcGroup(g.Name, "cmdline", g.Cmdline)
+	}
+	return rctl.ProcGroup{}, fmt.Errorf("group %q : expected exe or cmdline", g.Name)
+}
+
+func newProcGroup(name string, field string, value string) (rctl.ProcGroup, error) {
+	g, err := rctl.NewProcGroup(name, field, value)
+	if err != nil {
+		return g, fmt.Errorf("group %q : %w", name, err)
+	}
+	return g, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yo000/rctl_exporter/rctl"
+)
+
+// Returns the configuration file example of the README
+func readmeExample(t *testing.T) []byte {
+	data, err := ioutil.ReadFile("../README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := string(data)
+	i := strings.Index(s, "# Configuration file")
+	if i < 0 {
+		t.Fatal("README has no configuration file section")
+	}
+	s = s[i:]
+	start := strings.Index(s, "```\n")
+	end := strings.Index(s[start+4:], "```")
+	if start < 0 || end < 0 {
+		t.Fatal("README configuration file section has no example")
+	}
+
+	return []byte(s[start+4 : start+4+end])
+}
+
+func TestParseReadmeExample(t *testing.T) {
+	cfg, err := Parse(readmeExample(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Default()
+	want.RefreshInterval = 30 * time.Second
+	want.Process.Include = []string{"jail=web01,exe=nginx", "^/usr/local/bin/java"}
+	want.User = UserConfig{SubjectConfig: SubjectConfig{Include: []string{".*"}, Exclude: []string{"^(root|toor)$"}},
+		Source: rctl.USER_SOURCE_PASSWD, UidMin: 1000, UidMax: -1}
+	want.Jail = JailConfig{SubjectConfig: SubjectConfig{Include: []string{`^tenant1\.`}}, Rollup: true}
+	want.ProcGroups = []ProcGroupConfig{{Name: "postgres", Exe: "postgres"},
+		{Name: "java-apps", Cmdline: `~-jar (?P<app>[a-z]+)\.jar`}}
+	want.Resources = []string{"cputime", "memoryuse", "pcpu"}
+	want.Labels.Cmdline = false
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+
+	groups, err := cfg.ProcessGroups()
+	if err != nil || len(groups) != 2 || groups[1].Regexp == nil {
+		t.Errorf("got process groups %+v, error %v", groups, err)
+	}
+	names := cfg.ResourceNames()
+	if !reflect.DeepEqual(names, []rctl.ResourceName{"cputime", "memoryuse", "pcpu"}) {
+		t.Errorf("got resources %v", names)
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	for _, data := range []string{"", "# only a comment\n", "labels:\n  cmdline: false\n"} {
+		cfg, err := Parse([]byte(data))
+		if err != nil {
+			t.Errorf("%q : unexpected error %v", data, err)
+			continue
+		}
+		// Settings missing from the file keep their default
+		if !cfg.Labels.Captures || !cfg.Limits || cfg.Workers != rctl.DEFAULT_WORKERS || cfg.User.UidMax != -1 ||
+			cfg.User.Source != rctl.USER_SOURCE_UTMPX {
+			t.Errorf("%q : got %+v, want defaults", data, cfg)
+		}
+	}
+}
+
+func TestParseUnknownKeys(t *testing.T) {
+	for _, data := range []string{"wrokers: 2\n", "user:\n  uid_mni: 1000\n", "procgroups:\n  - name: x\n    exec: sh\n"} {
+		_, err := Parse([]byte(data))
+		if err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Errorf("%q : got error %v, want an unknown field", data, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		data string
+		msg  string
+	}{
+		{"refresh_interval: -1s", "refresh_interval: must not be negative, got -1s"},
+		{"workers: 0", "workers: must be at least 1, got 0"},
+		{`filters: ["process:^java", "foo:x"]`, `filters[1]: invalid filter "foo:x" : unknown subject foo`},
+		{`process: {include: ["pid=x"]}`, `process.include[0]: invalid filter "process:pid=x"`},
+		{`proctree: {exclude: ["("]}`, `proctree.exclude[0]: invalid filter "!proctree:("`},
+		{`user: {include: ["("]}`, `user.include[0]: invalid filter "user:("`},
+		{`jail: {exclude: ["("]}`, `jail.exclude[0]: invalid filter "!jail:("`},
+		{`loginclass: {include: ["("]}`, `loginclass.include[0]: invalid filter "loginclass:("`},
+		{"user: {source: nis}", `user.source: unknown source "nis", expected one of`},
+		{"user: {uid_min: -1}", "user.uid_min: must not be negative, got -1"},
+		{"user: {uid_min: 100, uid_max: 10}", "user.uid_max: must be -1 or not lower than uid_min, got 10"},
+		{"user: {uid_max: -2}", "user.uid_max: must be -1 or not lower than uid_min, got -2"},
+		{"procgroups: [{name: x}]", `procgroups[0]: group "x" : expected exe or cmdline`},
+		{"procgroups: [{name: x, exe: a, cmdline: b}]", `procgroups[0]: group "x" : exe and cmdline are exclusive`},
+		{"procgroups: [{name: x, cmdline: '~('}]", `procgroups[0]: group "x" : error parsing regexp`},
+		{"resources: [cputime, bogus]", `resources[1]: unknown resource "bogus"`},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.data))
+		if err == nil {
+			t.Errorf("%s : want an error", tt.data)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "invalid configuration:\n  "+tt.msg) {
+			t.Errorf("%s : got %q, want %q", tt.data, err, tt.msg)
+		}
+	}
+
+	// Every problem is reported at once
+	_, err := Parse([]byte("workers: 0\nresources: [bogus]\nuser: {source: nis}\n"))
+	if err == nil || strings.Count(err.Error(), "\n  ") != 3 {
+		t.Errorf("got %v, want 3 problems", err)
+	}
+}
+
+func TestAllFilters(t *testing.T) {
+	cfg, err := Parse([]byte(`
+filters: ["process:a{1,3}", "!jail:^build-"]
+loginclass: {include: [".*"]}
+jail: {include: ["^web"], exclude: ["^web-test"]}
+user: {exclude: ["^root$"], include: [".*"]}
+proctree: {include: ["pid=1"]}
+process: {include: ["^java"], exclude: ["user=root"]}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Filters first, then sections in a fixed order, includes before excludes
+	want := []string{"process:a{1,3}", "!jail:^build-", "process:^java", "!process:user=root", "proctree:pid=1",
+		"user:.*", "!user:^root$", "jail:^web", "!jail:^web-test", "loginclass:.*"}
+	if got := cfg.AllFilters(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2020, johan@nosd.in
+//
+// Output buffer sizing for rctl_get_racct, rctl_get_rules and rctl_get_limits
+package rctl
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	// First buffer size tried
+	RCTL_INITIAL_OUTBUFLEN = 1024
+	// Largest buffer accepted by the kernel, copied from sys/kern/kern_rctl.c
+	RCTL_MAX_OUTBUFLEN = 16 * 1024 * 1024
+)
+
+// Number of calls retried with a larger buffer since start
+var bufferRetries uint64
+
+// BufferTooSmallError : Returned when the output of a rctl call does not fit in the largest buffer allowed
+type BufferTooSmallError struct {
+	Call   string // Syscall name
+	Filter string // Filter passed to the call
+	Size   int    // Size of the last buffer tried
+}
+
+func (e *BufferTooSmallError) Error() string {
+	return fmt.Sprintf("%s(%s) output does not fit in %d bytes", e.Call, e.Filter, e.Size)
+}
+
+// BufferRetries : Returns how many rctl calls were retried because their output buffer was too small
+func BufferRetries() uint64 {
+	return atomic.LoadUint64(&bufferRetries)
+}
+
+// Runs call with a buffer doubling each time call returns ERANGE, until maxSize is reached.
+// call fills buf with a NUL terminated string, which is returned.
+func callWithBuffer(name string, filter string, maxSize int, call func(buf []byte) error) (string, error) {
+	size := RCTL_INITIAL_OUTBUFLEN
+	if size > maxSize {
+		size = maxSize
+	}
+
+	for {
+		buf := make([]byte, size)
+		err := call(buf)
+		if err == nil {
+			for i := range buf {
+				if buf[i] == 0 {
+					return string(buf[:i]), nil
+				}
+			}
+			return string(buf), nil
+		}
+		if !errors.Is(err, syscall.ERANGE) {
+			return "", err
+		}
+		if size >= maxSize {
+			return "", &BufferTooSmallError{Call: name, Filter: filter, Size: size}
+		}
+
+		atomic.AddUint64(&bufferRetries, 1)
+		size *= 2
+		if size > maxSize {
+			size = maxSize
+		}
+		GLog.Debugf("%s(%s) output truncated, retrying with %d bytes", name, filter, size)
+	}
+}
@@ -0,0 +1,61 @@
+package rctl
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCallWithBuffer(t *testing.T) {
+	tests := []struct {
+		len     int // Length of the output
+		retries uint64
+	}{
+		{0, 0},
+		{RCTL_INITIAL_OUTBUFLEN - 1, 0},
+		// No room left for the terminating NUL
+		{RCTL_INITIAL_OUTBUFLEN, 1},
+		{2000, 1},
+		{5000, 3},
+	}
+
+	f := NewFakeSource()
+	for _, tt := range tests {
+		out := strings.Repeat("x", tt.len)
+		f.Usage["jail:www"] = out
+
+		before := BufferRetries()
+		got, err := f.GetRacct("jail:www")
+		if err != nil {
+			t.Errorf("%d bytes : unexpected error %v", tt.len, err)
+			continue
+		}
+		if got != out {
+			t.Errorf("%d bytes : got %d bytes", tt.len, len(got))
+		}
+		if retries := BufferRetries() - before; retries != tt.retries {
+			t.Errorf("%d bytes : got %d retries, want %d", tt.len, retries, tt.retries)
+		}
+	}
+}
+
+func TestCallWithBufferTooSmall(t *testing.T) {
+	f := NewFakeSource()
+	f.MaxBufferSize = 3000
+	f.Usage["jail:www"] = strings.Repeat("x", 5000)
+	f.Usage["jail:db"] = strings.Repeat("x", 2999)
+
+	_, err := f.GetRacct("jail:www")
+	var be *BufferTooSmallError
+	if !errors.As(err, &be) {
+		t.Fatalf("got error %v, want a *BufferTooSmallError", err)
+	}
+	if be.Size != f.MaxBufferSize || be.Call != "rctl_get_racct" || be.Filter != "jail:www" {
+		t.Errorf("got %+v", be)
+	}
+
+	// Fits once the buffer is capped to the largest size
+	if out, err := f.GetRacct("jail:db"); err != nil || len(out) != 2999 {
+		t.Errorf("got %d bytes, error %v", len(out), err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2020, johan@nosd.in
+//
+// Named capture groups of filters, exported as metric labels
+package rctl
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Labels set by the collector for each subject, which capture groups can not override.
+// action and per are labels of limit metrics.
+var reservedLabels = map[string][]string{
+	"process":   {"pid", "name", "cmdline", "action", "per"},
+	"proctree":  {"pid", "name", "cmdline", "action", "per"},
+	"procgroup": {"group", "action", "per"},
+}
+
+// Returns names of capture groups of re, and an error for the first one which can not be a label of subject metrics
+func captureNames(subject string, re *regexp.Regexp) ([]string, error) {
+	var names []string
+
+	for _, name := range re.SubexpNames() {
+		if len(name) == 0 {
+			continue
+		}
+		if name[0] >= '0' && name[0] <= '9' || strings.HasPrefix(name, "__") || isReservedLabel(subject, name) {
+			return names, fmt.Errorf("capture group %s of %s can not be used as a label", name, re)
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// Returns values of named capture groups in a match of re, nil if it has none
+func captureValues(re *regexp.Regexp, match []string) map[string]string {
+	var values map[string]string
+
+	for i, name := range re.SubexpNames() {
+		if len(name) == 0 {
+			continue
+		}
+		if values == nil {
+			values = make(map[string]string)
+		}
+		values[name] = match[i]
+	}
+
+	return values
+}
+
+// Merges label names into a sorted union
+func mergeCaptureNames(union []string, names []string) []string {
+	for _, name := range names {
+		i := sort.SearchStrings(union, name)
+		if i < len(union) && union[i] == name {
+			continue
+		}
+		union = append(union, "")
+		copy(union[i+1:], union[i:])
+		union[i] = name
+	}
+
+	return union
+}
+
+func isReservedLabel(subject string, name string) bool {
+	for _, v := range reservedLabels[subject] {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
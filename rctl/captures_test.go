@@ -0,0 +1,69 @@
+package rctl
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestReservedCaptures(t *testing.T) {
+	tests := []struct {
+		filter string
+		valid  bool
+	}{
+		{`process:-jar (?P<app>\w+)`, true},
+		{`proctree:^(?P<app>java)`, true},
+		{`process:(?P<pid>\d+)`, false},
+		{`process:(?P<cmdline>.*)`, false},
+		// Labels of limit metrics
+		{`process:-jar (?P<action>[a-z]+)`, false},
+		{`process:-jar (?P<per>[a-z]+)`, false},
+		{`proctree:(?P<name>\w+)`, false},
+		{`proctree:(?P<action>\w+)`, false},
+		{`process:(?P<__name__>\w+)`, false},
+	}
+
+	for _, tt := range tests {
+		if err := CheckFilter(tt.filter); (err == nil) != tt.valid {
+			t.Errorf("CheckFilter(%q) = %v, want valid %v", tt.filter, err, tt.valid)
+		}
+	}
+
+	if _, err := NewProcGroup("java", "cmdline", `~-jar (?P<per>\w+)`); err == nil {
+		t.Error("NewProcGroup : want an error for capture group per")
+	}
+}
+
+func TestCaptureLabels(t *testing.T) {
+	f := NewFakeSource()
+	f.ProcessList = []Process{{Pid: 1, Name: "java", CmdLine: "java -jar billing.jar"},
+		{Pid: 2, Name: "java", CmdLine: "java -jar shop.jar"}, {Pid: 3, Name: "python", CmdLine: "python sync.py"}}
+	for _, p := range f.ProcessList {
+		f.Usage["process:"+strconv.Itoa(p.Pid)] = "memoryuse=1"
+	}
+
+	rm, err := NewResourceManager([]string{`process:-jar (?P<app>\w+)\.jar`, `!process:(?P<excluded>shop)`,
+		`proctree:^(?P<interpreter>python)`}, f, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := rm.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{"process": {"app"}, "proctree": {"interpreter"}}
+	if !reflect.DeepEqual(snap.Labels, want) {
+		t.Errorf("got labels %v, want %v", snap.Labels, want)
+	}
+	got := make(map[string]map[string]string)
+	for _, r := range snap.Resources {
+		got[r.ResourceID] = r.Captures
+	}
+	wantCaptures := map[string]map[string]string{"1": {"app": "billing"}, "3": {"interpreter": "python"}}
+	if !reflect.DeepEqual(got, wantCaptures) {
+		t.Errorf("got captures %v, want %v", got, wantCaptures)
+	}
+}
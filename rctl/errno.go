@@ -0,0 +1,40 @@
+// Copyright 2020, johan@nosd.in
+//
+// Names of errors returned by rctl syscalls, used as metric labels
+package rctl
+
+import (
+	"errors"
+	"strconv"
+	"syscall"
+)
+
+// Errors documented in rctl_get_racct(2), and those of listing processes, users and jails
+var errnoNames = map[syscall.Errno]string{
+	syscall.EPERM:        "EPERM",
+	syscall.ENOENT:       "ENOENT",
+	syscall.ESRCH:        "ESRCH",
+	syscall.EIO:          "EIO",
+	syscall.E2BIG:        "E2BIG",
+	syscall.ENOMEM:       "ENOMEM",
+	syscall.EACCES:       "EACCES",
+	syscall.EFAULT:       "EFAULT",
+	syscall.EINVAL:       "EINVAL",
+	syscall.ERANGE:       "ERANGE",
+	syscall.ENOSYS:       "ENOSYS",
+	syscall.ENAMETOOLONG: "ENAMETOOLONG",
+}
+
+// Returns the name of the errno of err, such as "ESRCH", or "other" when err is not a system error
+func errnoName(err error) string {
+	var errno syscall.Errno
+
+	if !errors.As(err, &errno) {
+		return "other"
+	}
+	if name, ok := errnoNames[errno]; ok {
+		return name
+	}
+
+	return "errno" + strconv.Itoa(int(errno))
+}
@@ -0,0 +1,94 @@
+package rctl
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestErrnoName(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{syscall.EPERM, "EPERM"},
+		{fmt.Errorf("rctl_get_racct(user:1001) : %w", syscall.ESRCH), "ESRCH"},
+		{syscall.Errno(200), "errno200"},
+		{errors.New("parse error"), "other"},
+		{&BufferTooSmallError{Call: "rctl_get_racct", Filter: "jail:www", Size: 1024}, "other"},
+	}
+
+	for _, tt := range tests {
+		if got := errnoName(tt.err); got != tt.want {
+			t.Errorf("errnoName(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFilterResults(t *testing.T) {
+	f := NewFakeSource()
+	f.ProcessList = []Process{{Pid: 1, Name: "java", CmdLine: "java -jar a.jar"}, {Pid: 2, Name: "java", CmdLine: "java -jar b.jar"}}
+	f.JailList = []Jail{{Name: "www", Jid: 1}}
+	f.UserList = []User{{Name: "alice", Uid: 1001}}
+	f.Usage["process:1"] = "cputime=1"
+	f.Usage["jail:www"] = "cputime=1"
+	// Process 2 exits before its usage is read
+	f.Errors["process:2"] = syscall.ESRCH
+	f.Errors["user:1001"] = syscall.EPERM
+
+	// The second jail filter is the same, it is only kept once
+	rm, err := NewResourceManager([]string{"process:^java", "jail:.*", "user:.*", "jail:.*"}, f, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm.Refresh()
+	snap, err := rm.Refresh()
+	if err == nil || !errors.Is(snap.Errors["user"], syscall.EPERM) {
+		t.Errorf("got error %v, user error %v, want EPERM", err, snap.Errors["user"])
+	}
+
+	var ids []string
+	for _, r := range snap.Resources {
+		ids = append(ids, r.rule)
+	}
+	if want := []string{"process:1:", "jail:www"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got resources %v, want %v", ids, want)
+	}
+
+	type result struct {
+		subject string
+		filter  string
+		failed  bool
+	}
+	var results []result
+	for _, fr := range snap.Filters {
+		results = append(results, result{fr.Subject, fr.Filter, fr.Err != nil})
+	}
+	want := []result{{"process", "process:^java", false}, {"jail", "jail:.*", false}, {"user", "user:.*", true}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got filter results %v, want %v", results, want)
+	}
+	if snap.AllFailed() {
+		t.Error("got all failed, want some filters succeeded")
+	}
+
+	// Counts go on across refreshes, exited processes are not failures
+	wantCounts := map[ErrorKey]uint64{{Subject: "user", Errno: "EPERM"}: 2}
+	if !reflect.DeepEqual(snap.ErrCounts, wantCounts) {
+		t.Errorf("got error counts %v, want %v", snap.ErrCounts, wantCounts)
+	}
+
+	f.Errors["jail:www"] = syscall.ENOSYS
+	f.Errors["process:1"] = syscall.ENOSYS
+	snap, _ = rm.Refresh()
+	if !snap.AllFailed() {
+		t.Errorf("got filter results %v, want all failed", snap.Filters)
+	}
+	if n := snap.ErrCounts[ErrorKey{Subject: "jail", Errno: "ENOSYS"}]; n != 1 {
+		t.Errorf("got %d jail ENOSYS errors, want 1", n)
+	}
+}
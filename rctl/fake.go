@@ -0,0 +1,118 @@
+// Copyright 2020, johan@nosd.in
+//
+// In-memory RacctSource, used to run ResourceMgr and the collector without a FreeBSD kernel
+package rctl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FakeSource : RacctSource serving fixtures.
+// Usage, Rules, Limits and Errors are keyed by "subject:id", as in "process:1234", "user:1001", "jail:www" or "loginclass:daemon"
+type FakeSource struct {
+	ProcessList    []Process
+	UserList       []User
+	AccountList    []User
+	JailList       []Jail
+	LoginClassList []LoginClass
+	Usage          map[string]string // Raw usage, as returned by rctl_get_racct
+	Rules          map[string]string // Raw rules, as returned by rctl_get_rules
+	Limits         map[string]string // Raw rules, as returned by rctl_get_limits
+	Errors         map[string]error  // Error returned by GetRacct for this subject
+	MaxBufferSize  int               // Largest output buffer, defaults to RCTL_MAX_OUTBUFLEN
+	Delay          time.Duration     // Latency added to each rctl call, to simulate a loaded host
+}
+
+// NewFakeSource : Returns an empty FakeSource
+func NewFakeSource() *FakeSource {
+	return &FakeSource{
+		Usage:  make(map[string]string),
+		Rules:  make(map[string]string),
+		Limits: make(map[string]string),
+		Errors: make(map[string]error),
+	}
+}
+
+// GetRacct : Returns fixture usage for filter, ESRCH if there is none
+func (f *FakeSource) GetRacct(filter string) (string, error) {
+	key := strings.TrimSuffix(filter, ":")
+
+	time.Sleep(f.Delay)
+	if err, ok := f.Errors[key]; ok {
+		return "", err
+	}
+	usage, ok := f.Usage[key]
+	if !ok {
+		return "", fmt.Errorf("no usage for %s: %w", key, syscall.ESRCH)
+	}
+
+	return f.copyOut("rctl_get_racct", filter, usage)
+}
+
+// GetRules : Returns fixture rules for filter, all of them for ":"
+func (f *FakeSource) GetRules(filter string) (string, error) {
+	time.Sleep(f.Delay)
+	if filter == ":" {
+		var all []string
+		for _, rules := range f.Rules {
+			if len(rules) > 0 {
+				all = append(all, rules)
+			}
+		}
+		sort.Strings(all)
+		return f.copyOut("rctl_get_rules", filter, strings.Join(all, ","))
+	}
+	return f.copyOut("rctl_get_rules", filter, f.Rules[strings.TrimSuffix(filter, ":")])
+}
+
+// GetLimits : Returns fixture limits for filter
+func (f *FakeSource) GetLimits(filter string) (string, error) {
+	time.Sleep(f.Delay)
+	return f.copyOut("rctl_get_limits", filter, f.Limits[strings.TrimSuffix(filter, ":")])
+}
+
+// Copies out to caller buffer like the kernel does, failing with ERANGE when it does not fit
+func (f *FakeSource) copyOut(name string, filter string, out string) (string, error) {
+	maxSize := f.MaxBufferSize
+	if maxSize <= 0 {
+		maxSize = RCTL_MAX_OUTBUFLEN
+	}
+
+	return callWithBuffer(name, filter, maxSize, func(buf []byte) error {
+		if len(out)+1 > len(buf) {
+			return syscall.ERANGE
+		}
+		copy(buf, out)
+		buf[len(out)] = 0
+		return nil
+	})
+}
+
+// Processes : Returns ProcessList
+func (f *FakeSource) Processes() ([]Process, error) {
+	return f.ProcessList, nil
+}
+
+// Users : Returns UserList
+func (f *FakeSource) Users() ([]User, error) {
+	return f.UserList, nil
+}
+
+// Accounts : Returns AccountList
+func (f *FakeSource) Accounts() ([]User, error) {
+	return f.AccountList, nil
+}
+
+// Jails : Returns JailList
+func (f *FakeSource) Jails() ([]Jail, error) {
+	return f.JailList, nil
+}
+
+// LoginClasses : Returns LoginClassList
+func (f *FakeSource) LoginClasses() ([]LoginClass, error) {
+	return f.LoginClassList, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2020, johan@nosd.in
+//
+// Filters selecting collected items, compiled once when the manager is configured
+package rctl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A filter such as "process:^java", "process:jail=web01,exe=nginx" or "!jail:^build-", ready to be matched
+type filter struct {
+	text    string         // Filter as configured, for logs
+	subject string         // One of FILTER_SUBJECTS
+	exclude bool           // Items matched are excluded from other filters of the subject
+	re      *regexp.Regexp // Regexp matched on the name, or on the command line of processes
+	sel     Selector       // Selector on process attributes, instead of re
+}
+
+// Compiles a filter, returns a descriptive error if it is invalid
+func compileFilter(text string) (filter, error) {
+	f := filter{text: text, exclude: strings.HasPrefix(text, "!")}
+
+	s := strings.SplitN(strings.TrimPrefix(text, "!"), ":", 2)
+	if len(s) != 2 {
+		return f, fmt.Errorf("invalid filter %q : expected subject:regexp", text)
+	}
+	f.subject = s[0]
+
+	var err error
+	switch f.subject {
+	case "process", "proctree":
+		f.sel, f.re, err = parseProcessFilter(f.subject, s[1])
+	case "user", "loginclass", "jail":
+		f.re, err = regexp.Compile(s[1])
+	default:
+		return f, fmt.Errorf("invalid filter %q : unknown subject %s, expected one of %s", text, f.subject,
+			strings.Join(FILTER_SUBJECTS, ", "))
+	}
+	if err != nil {
+		return f, fmt.Errorf("invalid filter %q : %w", text, err)
+	}
+
+	return f, nil
+}
+
+// Compiles filters, returns an error listing every invalid one. A filter given twice is only kept once.
+func compileFilters(texts []string) ([]filter, error) {
+	var filters []filter
+	var msgs []string
+
+	dups := make(map[string]bool)
+	for _, text := range texts {
+		if dups[text] {
+			continue
+		}
+		dups[text] = true
+		f, err := compileFilter(text)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		filters = append(filters, f)
+	}
+	if len(msgs) > 0 {
+		return filters, errors.New(strings.Join(msgs, "; "))
+	}
+
+	return filters, nil
+}
+
+// CheckFilter : Returns an error if a filter such as "process:^java" or "!jail:^build-" is invalid.
+// It checks the subject, and that the regexp or selector can be compiled, without listing anything.
+func CheckFilter(text string) error {
+	_, err := compileFilter(text)
+	return err
+}
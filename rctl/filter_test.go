@@ -0,0 +1,91 @@
+package rctl
+
+import (
+	"errors"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FakeSource whose password database can not be read
+type noAccountsSource struct{ *FakeSource }
+
+func (noAccountsSource) Accounts() ([]User, error) { return nil, syscall.EACCES }
+
+func resourceIDs(snap *Snapshot, resourceType int) []string {
+	var ids []string
+
+	for _, r := range snap.Resources {
+		if r.ResourceType == resourceType {
+			ids = append(ids, r.ResourceID)
+		}
+	}
+
+	return ids
+}
+
+func TestExcludeFilters(t *testing.T) {
+	f := NewFakeSource()
+	f.JailList = []Jail{{Name: "www", Jid: 1}, {Name: "build-1", Jid: 2}, {Name: "db", Jid: 3}, {Name: "build-www", Jid: 4}}
+	f.ProcessList = []Process{{Pid: 10, PPid: 1, Name: "nginx", CmdLine: "nginx: master process"},
+		{Pid: 11, PPid: 10, Name: "nginx", CmdLine: "nginx: worker process"},
+		{Pid: 20, PPid: 1, Name: "nginx", CmdLine: "nginx: master process", Uid: 80}}
+	for _, k := range []string{"jail:www", "jail:build-1", "jail:db", "jail:build-www", "process:10", "process:11", "process:20"} {
+		f.Usage[k] = "cputime=1"
+	}
+
+	rm, err := NewResourceManager(SplitFilters("jail:.*,jail:^w,!jail:^build-,proctree:^nginx: master,!proctree:pid=20"),
+		f, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := rm.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each jail is collected once, whatever the number of filters matching it
+	if got := resourceIDs(snap, RESRC_JAIL); !reflect.DeepEqual(got, []string{"1", "3"}) {
+		t.Errorf("got jails %v, want [1 3]", got)
+	}
+	// The tree rooted at 20 is excluded
+	if got := resourceIDs(snap, RESRC_PROCTREE); !reflect.DeepEqual(got, []string{"10"}) {
+		t.Errorf("got trees %v, want [10]", got)
+	}
+}
+
+func TestExcludeFilterFailure(t *testing.T) {
+	f := NewFakeSource()
+	f.JailList = []Jail{{Name: "www", Jid: 1}}
+	f.ProcessList = []Process{{Pid: 10, Name: "nginx", CmdLine: "nginx"}}
+	f.Usage["jail:www"] = "cputime=1"
+	f.Usage["process:10"] = "cputime=1"
+
+	// The user selector needs the password database
+	rm, err := NewResourceManager([]string{"process:.*", "!process:user=root", "jail:.*"}, noAccountsSource{f}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := rm.Refresh()
+	if err == nil {
+		t.Fatal("want an error")
+	}
+
+	// Processes are not collected without their exclusions, other subjects are
+	if got := resourceIDs(snap, RESRC_PROCESS); got != nil {
+		t.Errorf("got processes %v, want none", got)
+	}
+	if got := resourceIDs(snap, RESRC_JAIL); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("got jails %v, want [1]", got)
+	}
+	if err := snap.Errors["process"]; !errors.Is(err, syscall.EACCES) {
+		t.Errorf("got process error %v, want EACCES", err)
+	}
+	for _, fr := range snap.Filters {
+		if failed := fr.Subject == "process"; (fr.Err != nil) != failed {
+			t.Errorf("%s : got error %v", fr.Filter, fr.Err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020, johan@nosd.in
+//
+// Hierarchical jails : jails created inside a jail (children.max > 0) are named "parent.child"
+package rctl
+
+import (
+	"errors"
+	"strconv"
+	"syscall"
+)
+
+// Returns the name of the parent jail of jl, empty for jails created on the host
+// or whose parent is not visible
+func jailParentName(jls []Jail, jl Jail) string {
+	if jl.Parent == 0 {
+		return ""
+	}
+	for _, p := range jls {
+		if p.Jid == jl.Parent {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+// Gets usage of the ancestors of collected jails which are not collected themselves, so each tenant gets
+// a total even when only its child jails are collected. RACCT charges a jail usage to all its ancestors,
+// so the usage of an ancestor read from the kernel already includes all its children, collected or not.
+func rollupJails(src RacctSource, resources []Resource, workers int) ([]Resource, error) {
+	var rollups []Resource
+
+	jls, err := src.Jails()
+	if err != nil {
+		return rollups, err
+	}
+
+	byJid := make(map[int]Jail)
+	for _, jl := range jls {
+		byJid[jl.Jid] = jl
+	}
+
+	collected := make(map[int]bool)
+	for _, r := range resources {
+		if r.ResourceType == RESRC_JAIL {
+			collected[r.JailParams.Jid] = true
+		}
+	}
+
+	ancestors := make(map[int]bool)
+	for jid := range collected {
+		for jl, ok := byJid[jid]; ok && jl.Parent != 0; jl, ok = byJid[jl.Parent] {
+			if !collected[jl.Parent] {
+				ancestors[jl.Parent] = true
+			}
+		}
+	}
+
+	// Keep listing order
+	for _, jl := range jls {
+		if !ancestors[jl.Jid] {
+			continue
+		}
+		rollups = append(rollups, Resource{
+			ResourceID: strconv.Itoa(jl.Jid),
+			JailName:   jl.Name,
+			JailParent: jailParentName(jls, jl),
+			JailParams: jl,
+			rule:       "jail:" + jl.Name,
+		})
+	}
+
+	errs := forEachResource(rollups, workers, func(r *Resource) error {
+		usage, err := getResourceUsage(src, r.rule)
+		if err != nil {
+			return err
+		}
+		r.ResourceType = RESRC_JAIL_ROLLUP
+		r.RawResources = usage.RawResources
+		r.Usage = usage.Usage
+		return nil
+	})
+
+	kept := rollups[:0]
+	for i, err := range errs {
+		if errors.Is(err, syscall.ESRCH) {
+			GLog.Debug("Skipped rollup of " + rollups[i].rule + " : it disappeared before its usage was read")
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, rollups[i])
+	}
+
+	return kept, nil
+}
@@ -0,0 +1,56 @@
+package rctl
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRollupJails(t *testing.T) {
+	f := NewFakeSource()
+	f.JailList = []Jail{{Name: "t1", Jid: 1}, {Name: "t1.a", Jid: 2, Parent: 1}, {Name: "t1.b", Jid: 3, Parent: 1},
+		{Name: "t1.b.c", Jid: 4, Parent: 3}, {Name: "t2", Jid: 5}, {Name: "t2.a", Jid: 6, Parent: 5},
+		{Name: "t3", Jid: 7}, {Name: "t3.a", Jid: 8, Parent: 7}}
+	// Usage of a jail includes its children, as RACCT charges it to ancestors
+	f.Usage["jail:t1"] = "memoryuse=40"
+	f.Usage["jail:t1.a"] = "memoryuse=10"
+	f.Usage["jail:t1.b"] = "memoryuse=25"
+	f.Usage["jail:t1.b.c"] = "memoryuse=5"
+	f.Usage["jail:t2"] = "memoryuse=7"
+	f.Usage["jail:t2.a"] = "memoryuse=3"
+	// t3 disappears before its usage is read
+	f.Usage["jail:t3.a"] = "memoryuse=1"
+
+	rm, err := NewResourceManager([]string{"jail:^t1\\.", "jail:^t2", "jail:^t3\\."}, f, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm.JailRollup = true
+	snap, err := rm.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]int64)
+	parents := make(map[string]string)
+	for _, r := range snap.Resources {
+		if r.ResourceType == RESRC_JAIL_ROLLUP {
+			got[r.JailName] = r.Usage["memoryuse"]
+		}
+		parents[r.JailName] = r.JailParent
+	}
+	// Only t1 is not collected while its children are, t2 is collected
+	want := map[string]int64{"t1": 40}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got rollups %v, want %v", got, want)
+	}
+	if parents["t1.b.c"] != "t1.b" || parents["t1"] != "" {
+		t.Errorf("got parents %v", parents)
+	}
+	for _, fr := range snap.Filters {
+		if fr.Err != nil {
+			t.Errorf("%s %s : unexpected error %v", fr.Subject, fr.Filter, fr.Err)
+		}
+	}
+}
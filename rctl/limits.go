@@ -0,0 +1,88 @@
+// Copyright 2020, johan@nosd.in
+//
+// Limits configured with rctl(8) for collected subjects
+package rctl
+
+import (
+	"strings"
+)
+
+// Raw rules of all subjects, by "subject:subject-id" as in "jail:www" or "user:1001"
+type ruleIndex map[string][]string
+
+// Reads rules of all subjects with a single rctl_get_rules call. When they can not be read, the index is empty,
+// so processes limits are still collected.
+func readRules(src RacctSource) ruleIndex {
+	rules := make(ruleIndex)
+
+	// Empty subject matches all rules, as rctl(8) does without argument
+	raw, err := src.GetRules(":")
+	if err != nil {
+		GLog.Debug("Could not get rules : " + err.Error())
+		return rules
+	}
+	for _, rule := range strings.Split(raw, ",") {
+		// subject:subject-id:resource:action=amount
+		s := strings.SplitN(rule, ":", 3)
+		if len(s) != 3 {
+			continue
+		}
+		key := s[0] + ":" + s[1]
+		rules[key] = append(rules[key], rule)
+	}
+
+	return rules
+}
+
+// Returns rules applying to rule subject.
+// rctl_get_limits gives processes the rules inherited from their user, login class and jail. Rules of other
+// subjects are looked up in rules.
+func getLimits(src RacctSource, rule string, rules ruleIndex) ([]Rule, error) {
+	subject, err := checkSubject(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	if subject != "process" {
+		return parseLimits(strings.Join(rules[strings.TrimSuffix(rule, ":")], ",")), nil
+	}
+	raw, err := src.GetLimits(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLimits(raw), nil
+}
+
+// Parses rules as returned by the kernel, comma separated.
+// When several rules share resource, action and per, only the lowest amount is kept as it is the one enforced.
+func parseLimits(raw string) []Rule {
+	var limits []Rule
+
+	for _, rule := range strings.Split(raw, ",") {
+		if len(rule) == 0 {
+			continue
+		}
+		l, err := ParseRule(rule)
+		if err != nil {
+			GLog.Debug("Ignoring rule : " + err.Error())
+			continue
+		}
+
+		dup := false
+		for i := range limits {
+			if limits[i].Resource == l.Resource && limits[i].Action == l.Action && limits[i].PerSubject() == l.PerSubject() {
+				if l.Amount < limits[i].Amount {
+					limits[i] = l
+				}
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			limits = append(limits, l)
+		}
+	}
+
+	return limits
+}
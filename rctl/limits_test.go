@@ -0,0 +1,66 @@
+package rctl
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func limitsSource() *FakeSource {
+	f := NewFakeSource()
+	f.JailList = []Jail{{Name: "www", Jid: 1}, {Name: "db", Jid: 2}}
+	f.Usage["jail:www"] = "memoryuse=1024"
+	f.Usage["jail:db"] = "memoryuse=2048"
+	f.Rules["jail:www"] = "jail:www:memoryuse:deny=4096,jail:www:memoryuse:deny=2048,jail:www:maxproc:deny=10/process"
+	f.Rules["user:1001"] = "user:1001:memoryuse:deny=1g"
+	f.ProcessList = []Process{{Pid: 10, Name: "sh", CmdLine: "sh"}}
+	f.Usage["process:10"] = "memoryuse=512"
+	f.Limits["process:10"] = "user:1001:memoryuse:deny=1073741824"
+	return f
+}
+
+func TestLimits(t *testing.T) {
+	rm, err := NewResourceManager([]string{"jail:.*", "process:^sh"}, limitsSource(), logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := rm.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]Rule{
+		// Lowest of rules with the same action is kept
+		"1": {{Subject: "jail", SubjectID: "www", Resource: "memoryuse", Action: "deny", Amount: 2048},
+			{Subject: "jail", SubjectID: "www", Resource: "maxproc", Action: "deny", Amount: 10, Per: "process"}},
+		"2":  nil,
+		"10": {{Subject: "user", SubjectID: "1001", Resource: "memoryuse", Action: "deny", Amount: 1 << 30}},
+	}
+	if len(snap.Resources) != len(want) {
+		t.Fatalf("got %d resources, want %d", len(snap.Resources), len(want))
+	}
+	for _, r := range snap.Resources {
+		if !reflect.DeepEqual(r.Limits, want[r.ResourceID]) {
+			t.Errorf("%s: got limits %v, want %v", r.rule, r.Limits, want[r.ResourceID])
+		}
+	}
+}
+
+func TestLimitsDisabled(t *testing.T) {
+	rm, err := NewResourceManager([]string{"jail:.*", "process:^sh"}, limitsSource(), logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm.Limits = false
+	snap, err := rm.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range snap.Resources {
+		if r.Limits != nil {
+			t.Errorf("%s: got limits %v, want none", r.rule, r.Limits)
+		}
+	}
+}
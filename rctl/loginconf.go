@@ -0,0 +1,447 @@
+// Copyright 2020, johan@nosd.in
+//
+// login.conf(5) parser, for the getcap(3) database format
+package rctl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	LOGIN_CONF = "/etc/login.conf"
+
+	// RLIM_INFINITY from sys/resource.h, value of "infinity" or "unlimited" capabilities
+	LOGIN_INFINITY = math.MaxInt64
+
+	// Maximum depth of tc= inclusions, as MAX_RECURSION in getcap.c
+	LOGIN_MAX_RECURSION = 32
+)
+
+// LoginClass : A login class record, with tc= capabilities resolved
+type LoginClass struct {
+	Name        string
+	Aliases     []string          // Other names of the class
+	Description string            // Last name of the record, when it contains blanks
+	Caps        map[string]string // Capabilities values, empty for booleans. Cancelled "name@" capabilities are not set.
+}
+
+// Raw record, before tc= resolution
+type loginRecord struct {
+	names  []string
+	fields []string
+}
+
+// ParseLoginConf : Parses records in login.conf format. Records span lines ending with a backslash,
+// fields are separated by ':', first field lists class names separated by '|'.
+// A capability found several times keeps its first value, and tc=class includes capabilities of class at its position.
+// Classes with a tc= loop are skipped, as cgetent(3) only fails for them.
+func ParseLoginConf(r io.Reader) ([]LoginClass, error) {
+	var records []loginRecord
+	var classes []LoginClass
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), 1024*1024)
+	var line strings.Builder
+	for scanner.Scan() {
+		text := scanner.Text()
+		if strings.HasSuffix(text, "\\") && !strings.HasSuffix(text, "\\\\") {
+			line.WriteString(text[:len(text)-1])
+			continue
+		}
+		line.WriteString(text)
+		rec, ok := parseLoginRecord(line.String())
+		line.Reset()
+		if ok {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return classes, err
+	}
+	// Last line continued up to end of file
+	if rec, ok := parseLoginRecord(line.String()); ok {
+		records = append(records, rec)
+	}
+
+	byName := make(map[string]loginRecord)
+	for _, rec := range records {
+		for _, name := range rec.names {
+			// First record wins, as cgetent(3) searches in file order
+			if _, ok := byName[name]; !ok {
+				byName[name] = rec
+			}
+		}
+	}
+
+	expanded := make(map[string][]string)
+	emitted := make(map[string]bool)
+	for _, rec := range records {
+		// Shadowed by a previous record with the same name
+		if emitted[rec.names[0]] {
+			continue
+		}
+		emitted[rec.names[0]] = true
+
+		fields, err := expandLoginRecord(byName, expanded, rec, 0)
+		if err != nil {
+			GLog.Warnf("Skipping login class %s : %v", rec.names[0], err)
+			continue
+		}
+
+		lc := LoginClass{Name: rec.names[0], Caps: make(map[string]string)}
+		for _, name := range rec.names[1:] {
+			if strings.ContainsAny(name, " \t") {
+				lc.Description = name
+			} else {
+				lc.Aliases = append(lc.Aliases, name)
+			}
+		}
+
+		cancelled := make(map[string]bool)
+		for _, f := range fields {
+			name, value := f, ""
+			if i := strings.IndexAny(f, "=#@"); i >= 0 {
+				name, value = f[:i], f[i+1:]
+				if f[i] == '@' {
+					cancelled[name] = true
+					continue
+				}
+			}
+			if _, ok := lc.Caps[name]; ok || cancelled[name] {
+				continue
+			}
+			lc.Caps[name] = unescapeLoginValue(value)
+		}
+		classes = append(classes, lc)
+	}
+
+	return classes, nil
+}
+
+// Splits a logical line into a record, false for comments and blank lines
+func parseLoginRecord(line string) (loginRecord, bool) {
+	var rec loginRecord
+
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return rec, false
+	}
+
+	fields := splitLoginFields(line)
+	rec.names = strings.Split(fields[0], "|")
+	if len(rec.names[0]) == 0 {
+		return rec, false
+	}
+	for _, f := range fields[1:] {
+		// Continuation lines are indented, leaving blank fields
+		f = strings.TrimSpace(f)
+		if len(f) > 0 {
+			rec.fields = append(rec.fields, f)
+		}
+	}
+
+	return rec, true
+}
+
+// Splits on ':' not escaped by a backslash
+func splitLoginFields(line string) []string {
+	var fields []string
+
+	start := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case ':':
+			fields = append(fields, line[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(fields, line[start:])
+}
+
+// Replaces tc= fields by the fields of the included record. Expanded records are cached by name,
+// so a class included by many others is expanded once. Only the first field of each capability is kept,
+// as it is the one used, so records included several times do not grow the fields.
+func expandLoginRecord(byName map[string]loginRecord, expanded map[string][]string, rec loginRecord, depth int) ([]string, error) {
+	var fields []string
+
+	if f, ok := expanded[rec.names[0]]; ok {
+		return f, nil
+	}
+	if depth > LOGIN_MAX_RECURSION {
+		return fields, fmt.Errorf("tc= reference loop")
+	}
+
+	for _, f := range rec.fields {
+		if !strings.HasPrefix(f, "tc=") {
+			fields = append(fields, f)
+			continue
+		}
+		inc, ok := byName[f[3:]]
+		if !ok {
+			// cgetent(3) also ignores a tc= it can not resolve
+			continue
+		}
+		incFields, err := expandLoginRecord(byName, expanded, inc, depth+1)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, incFields...)
+	}
+	fields = firstLoginFields(fields)
+	expanded[rec.names[0]] = fields
+
+	return fields, nil
+}
+
+// Keeps the first field of each capability, a "name@" cancellation included
+func firstLoginFields(fields []string) []string {
+	var first []string
+
+	seen := make(map[string]bool)
+	for _, f := range fields {
+		name := f
+		if i := strings.IndexAny(f, "=#@"); i >= 0 {
+			name = f[:i]
+		}
+		if !seen[name] {
+			seen[name] = true
+			first = append(first, f)
+		}
+	}
+
+	return first
+}
+
+// Decodes getcap(3) escapes : \E, \n, \r, \t, \b, \f, \\, \:, \^X and octal \nnn
+func unescapeLoginValue(value string) string {
+	if !strings.ContainsAny(value, "\\^") {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '^' && i+1 < len(value) {
+			i++
+			b.WriteByte(value[i] & 037)
+			continue
+		}
+		if c != '\\' || i+1 >= len(value) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = value[i]; c {
+		case 'E', 'e':
+			b.WriteByte(033)
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			n := 0
+			for j := 0; j < 3 && i < len(value) && value[i] >= '0' && value[i] <= '7'; j++ {
+				n = n*8 + int(value[i]-'0')
+				i++
+			}
+			i--
+			b.WriteByte(byte(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// ReadLoginConf : Parses a login.conf file
+func ReadLoginConf(file string) ([]LoginClass, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseLoginConf(f)
+}
+
+// Has : Returns true if the capability is set
+func (lc LoginClass) Has(name string) bool {
+	_, ok := lc.Caps[name]
+	return ok
+}
+
+// Number : Returns a numeric capability, as login_getcapnum(3). Set is false when the capability is missing.
+func (lc LoginClass) Number(name string) (int64, bool, error) {
+	value, ok := lc.Caps[name]
+	if !ok {
+		return 0, false, nil
+	}
+	if isLoginInfinity(value) {
+		return LOGIN_INFINITY, true, nil
+	}
+	v, err := strconv.ParseInt(value, 0, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("login class %s: invalid number %s=%s", lc.Name, name, value)
+	}
+
+	return v, true, nil
+}
+
+// Multipliers of size suffixes, as in login_cap.c. "b" is a 512 bytes block.
+var loginSizeSuffixes = map[byte]int64{
+	'b': 512,
+	'k': 1 << 10,
+	'm': 1 << 20,
+	'g': 1 << 30,
+	't': 1 << 40,
+}
+
+// Size : Returns a size capability in bytes, as login_getcapsize(3). Values like "1g512m" are summed.
+func (lc LoginClass) Size(name string) (int64, bool, error) {
+	return lc.sumUnits(name, loginSizeSuffixes)
+}
+
+// Multipliers of time suffixes, as in login_cap.c
+var loginTimeSuffixes = map[byte]int64{
+	's': 1,
+	'm': 60,
+	'h': 60 * 60,
+	'd': 60 * 60 * 24,
+	'w': 60 * 60 * 24 * 7,
+	'y': 60 * 60 * 24 * 365,
+}
+
+// Time : Returns a time capability in seconds, as login_getcaptime(3). Values like "1h30m" are summed.
+func (lc LoginClass) Time(name string) (int64, bool, error) {
+	return lc.sumUnits(name, loginTimeSuffixes)
+}
+
+// Parses a sequence of numbers, each with an optional suffix
+func (lc LoginClass) sumUnits(name string, suffixes map[byte]int64) (int64, bool, error) {
+	var total int64
+
+	value, ok := lc.Caps[name]
+	if !ok {
+		return 0, false, nil
+	}
+	if isLoginInfinity(value) {
+		return LOGIN_INFINITY, true, nil
+	}
+
+	invalid := fmt.Errorf("login class %s: invalid value %s=%s", lc.Name, name, value)
+	rest := value
+	for len(rest) > 0 {
+		n := len(rest) - len(strings.TrimLeft(rest, "0123456789"))
+		if n == 0 {
+			return 0, true, invalid
+		}
+		v, err := strconv.ParseInt(rest[:n], 10, 64)
+		if err != nil {
+			return 0, true, invalid
+		}
+		rest = rest[n:]
+
+		mult := int64(1)
+		if len(rest) > 0 {
+			c := rest[0]
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if m, ok := suffixes[c]; ok {
+				mult = m
+				rest = rest[1:]
+			}
+		}
+		if v > (LOGIN_INFINITY-total)/mult {
+			return LOGIN_INFINITY, true, nil
+		}
+		total += v * mult
+	}
+
+	return total, true, nil
+}
+
+// Resource limits of login.conf, with the parser and unit of their value, as in login_cap.c
+var loginResourceCaps = []struct {
+	name  ResourceName
+	parse func(LoginClass, string) (int64, bool, error)
+	unit  string
+}{
+	{"cputime", LoginClass.Time, "seconds"},
+	{"filesize", LoginClass.Size, "bytes"},
+	{"datasize", LoginClass.Size, "bytes"},
+	{"stacksize", LoginClass.Size, "bytes"},
+	{"coredumpsize", LoginClass.Size, "bytes"},
+	{"memoryuse", LoginClass.Size, "bytes"},
+	{"memorylocked", LoginClass.Size, "bytes"},
+	{"maxproc", LoginClass.Number, ""},
+	{"openfiles", LoginClass.Number, ""},
+	{"sbsize", LoginClass.Size, "bytes"},
+	{"vmemoryuse", LoginClass.Size, "bytes"},
+	{"pseudoterminals", LoginClass.Number, ""},
+	{"swapuse", LoginClass.Size, "bytes"},
+	{"kqueues", LoginClass.Number, ""},
+	{"umtxp", LoginClass.Number, ""},
+	{"pipebuf", LoginClass.Size, "bytes"},
+}
+
+// LoginResourceUnit : Returns the unit of a login.conf resource limit, as "bytes", empty for a count.
+// The second value is false when login.conf has no such limit.
+func LoginResourceUnit(name ResourceName) (string, bool) {
+	for _, rc := range loginResourceCaps {
+		if rc.name == name {
+			return rc.unit, true
+		}
+	}
+	return "", false
+}
+
+// ResourceLimits : Returns hard resource limits of the class, from "resource-max" or "resource" capabilities,
+// as setusercontext(3) sets them. Unlimited resources are not returned.
+// Invalid values are skipped, and the error of the last one is returned.
+func (lc LoginClass) ResourceLimits() (map[ResourceName]int64, error) {
+	var err error
+	limits := make(map[ResourceName]int64)
+
+	for _, rc := range loginResourceCaps {
+		for _, name := range []string{string(rc.name) + "-max", string(rc.name)} {
+			v, ok, perr := rc.parse(lc, name)
+			if perr != nil {
+				err = perr
+			}
+			if !ok || perr != nil {
+				continue
+			}
+			if v != LOGIN_INFINITY {
+				limits[rc.name] = v
+			}
+			break
+		}
+	}
+
+	return limits, err
+}
+
+func isLoginInfinity(value string) bool {
+	switch strings.ToLower(value) {
+	case "infinity", "inf", "unlimited", "unlimit":
+		return true
+	}
+	return false
+}
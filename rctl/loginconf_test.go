@@ -0,0 +1,219 @@
+package rctl
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readTestLoginConf(t *testing.T) map[string]LoginClass {
+	lcs, err := ReadLoginConf("testdata/login.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := make(map[string]LoginClass)
+	var names []string
+	for _, lc := range lcs {
+		byName[lc.Name] = lc
+		names = append(names, lc.Name)
+	}
+	// Classes in a tc= loop are skipped, a shadowed record is not returned
+	want := []string{"default", "standard", "xuser", "russian", "daemon", "staff"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got classes %v, want %v", names, want)
+	}
+
+	return byName
+}
+
+func TestParseLoginConf(t *testing.T) {
+	lcs := readTestLoginConf(t)
+
+	def := lcs["default"]
+	tests := []struct {
+		lc    LoginClass
+		name  string
+		value string // Empty when the capability is not set
+	}{
+		{def, "passwd_format", "sha512"},
+		{def, "path", "/sbin /bin /usr/sbin /usr/bin ~/bin"},
+		{def, "setenv", "BLOCKSIZE=K"},
+		// Escapes, including an escaped ':'
+		{def, "prompt", "a:b\033:"},
+		// Cancelled before being set
+		{def, "ignoretime", ""},
+		// Included by tc=
+		{lcs["standard"], "copyright", "/etc/COPYRIGHT"},
+		{lcs["staff"], "passwd_format", "sha512"},
+		{lcs["russian"], "charset", "UTF-8"},
+		{lcs["russian"], "passwd_format", "sha512"},
+		// Cancelled before tc=
+		{lcs["daemon"], "stacksize", ""},
+		// First value wins, before tc=
+		{lcs["daemon"], "maxproc", "200"},
+		{lcs["xuser"], "maxproc", "50"},
+	}
+	for _, tt := range tests {
+		value, ok := tt.lc.Caps[tt.name]
+		if ok != (len(tt.value) > 0) || value != tt.value {
+			t.Errorf("%s %s : got %q (set %v), want %q", tt.lc.Name, tt.name, value, ok, tt.value)
+		}
+		if tt.lc.Has(tt.name) != ok {
+			t.Errorf("%s %s : Has() does not match Caps", tt.lc.Name, tt.name)
+		}
+	}
+
+	if !reflect.DeepEqual(lcs["standard"].Caps, def.Caps) {
+		t.Errorf("standard : got %v, want capabilities of default", lcs["standard"].Caps)
+	}
+	ru := lcs["russian"]
+	if !reflect.DeepEqual(ru.Aliases, []string{"ru"}) || ru.Description != "Russian Users Accounts" {
+		t.Errorf("russian : got aliases %v, description %q", ru.Aliases, ru.Description)
+	}
+	if xu := lcs["xuser"]; len(xu.Aliases) != 0 || xu.Description != "X users" {
+		t.Errorf("xuser : got aliases %v, description %q", xu.Aliases, xu.Description)
+	}
+}
+
+func TestLoginClassValues(t *testing.T) {
+	lcs := readTestLoginConf(t)
+
+	tests := []struct {
+		class string
+		name  string
+		parse func(LoginClass, string) (int64, bool, error)
+		want  int64
+		set   bool
+		err   bool
+	}{
+		{"default", "cputime", LoginClass.Time, LOGIN_INFINITY, true, false},
+		{"russian", "cputime", LoginClass.Time, 2*3600 + 30*60, true, false},
+		{"russian", "cputime-max", LoginClass.Time, 86400, true, false},
+		{"russian", "charset", LoginClass.Time, 0, true, true},
+		{"default", "datasize", LoginClass.Size, 1<<30 + 512<<20, true, false},
+		{"russian", "vmemoryuse", LoginClass.Size, 512 * 512, true, false},
+		{"daemon", "memorylocked", LoginClass.Size, 128 << 20, true, false},
+		{"default", "memoryuse", LoginClass.Size, LOGIN_INFINITY, true, false},
+		{"daemon", "stacksize", LoginClass.Size, 0, false, false},
+		{"default", "maxproc", LoginClass.Number, 100, true, false},
+		{"default", "umask", LoginClass.Number, 022, true, false},
+		{"default", "openfiles", LoginClass.Number, LOGIN_INFINITY, true, false},
+		{"staff", "pseudoterminals", LoginClass.Number, 0, true, true},
+		{"staff", "kqueues", LoginClass.Number, 0, false, false},
+	}
+
+	for _, tt := range tests {
+		got, set, err := tt.parse(lcs[tt.class], tt.name)
+		if got != tt.want || set != tt.set || (err != nil) != tt.err {
+			t.Errorf("%s %s : got %d (set %v, error %v), want %d (set %v, error %v)", tt.class, tt.name,
+				got, set, err, tt.want, tt.set, tt.err)
+		}
+	}
+}
+
+func TestResourceLimits(t *testing.T) {
+	lcs := readTestLoginConf(t)
+
+	// Unlimited resources are left out, resource-max is preferred
+	limits, err := lcs["russian"].ResourceLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[ResourceName]int64{"cputime": 86400, "datasize": 1<<30 + 512<<20, "stacksize": 64 << 20,
+		"maxproc": 100, "vmemoryuse": 512 * 512}
+	if !reflect.DeepEqual(limits, want) {
+		t.Errorf("russian : got %v, want %v", limits, want)
+	}
+
+	// Invalid values are skipped and reported
+	limits, err = lcs["staff"].ResourceLimits()
+	if err == nil {
+		t.Error("staff : want an error for pseudoterminals")
+	}
+	if _, ok := limits["pseudoterminals"]; ok || limits["openfiles"] != 4096 {
+		t.Errorf("staff : got %v", limits)
+	}
+}
+
+func TestParseLoginConfContinuations(t *testing.T) {
+	tests := []struct {
+		conf string
+		want []LoginClass
+	}{
+		// Last line continued up to end of file
+		{"a:\\\n\t:x=1:\\", []LoginClass{{Name: "a", Caps: map[string]string{"x": "1"}}}},
+		// An escaped backslash does not continue the line
+		{"a:x=1\\\\\nb:y:", []LoginClass{{Name: "a", Caps: map[string]string{"x": "1\\"}},
+			{Name: "b", Caps: map[string]string{"y": ""}}}},
+		// Blank fields of indented continuation lines are ignored
+		{"a:\\\n  :  :x#2:\\\n\n", []LoginClass{{Name: "a", Caps: map[string]string{"x": "2"}}}},
+		// Unknown tc= is ignored
+		{"a:tc=none:x=1:", []LoginClass{{Name: "a", Caps: map[string]string{"x": "1"}}}},
+		{"# only a comment\n\n", nil},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLoginConf(strings.NewReader(tt.conf))
+		if err != nil {
+			t.Errorf("%q : unexpected error %v", tt.conf, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q : got %+v, want %+v", tt.conf, got, tt.want)
+		}
+	}
+}
+
+func FuzzParseLoginConf(f *testing.F) {
+	data, err := os.ReadFile("testdata/login.conf")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(string(data))
+	f.Add("a:tc=b:\nb:tc=a:x=1:")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		lcs, err := ParseLoginConf(strings.NewReader(s))
+		if err != nil {
+			return
+		}
+		for _, lc := range lcs {
+			for name := range lc.Caps {
+				lc.Number(name)
+				lc.Size(name)
+				lc.Time(name)
+			}
+			lc.ResourceLimits()
+		}
+	})
+}
+
+func TestParseLoginConfRepeatedIncludes(t *testing.T) {
+	// Each class includes the next one twice, directly and through another class
+	var b strings.Builder
+	const depth = 30
+	for i := 0; i < depth; i++ {
+		fmt.Fprintf(&b, "c%d:x%d=%d:tc=c%d:tc=d%d:tc=c%d:\n", i, i, i, i+1, i, i+1)
+		fmt.Fprintf(&b, "d%d:tc=c%d:\n", i, i+1)
+	}
+	fmt.Fprintf(&b, "c%d:last:\n", depth)
+
+	start := time.Now()
+	lcs, err := ParseLoginConf(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("parsing took %v", elapsed)
+	}
+	if len(lcs) != 2*depth+1 {
+		t.Fatalf("got %d classes, want %d", len(lcs), 2*depth+1)
+	}
+	if c0 := lcs[0]; len(c0.Caps) != depth+1 || c0.Caps["x29"] != "29" || !c0.Has("last") {
+		t.Errorf("c0 : got %d capabilities %v", len(c0.Caps), c0.Caps)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2020, johan@nosd.in
+//
+// Named groups of processes, whose usage is summed instead of being exported by PID
+package rctl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ProcGroup : A named group of processes, matched on their binary name or command line
+type ProcGroup struct {
+	Name   string
+	Field  string         // "exe" to match binary name, "cmdline" to match full command line
+	Value  string         // Exact value, when Regexp is nil
+	Regexp *regexp.Regexp // Regexp searched in Field, for "field=~regexp" matchers
+}
+
+// ParseProcGroup : Parses a group definition such as "postgres: exe=postgres" or "java-apps: cmdline=~.*-jar (\S+)"
+func ParseProcGroup(def string) (ProcGroup, error) {
+	var g ProcGroup
+
+	s := strings.SplitN(def, ":", 2)
+	if len(s) != 2 {
+		return g, fmt.Errorf("invalid process group %q : expected name: exe=value or name: cmdline=~regexp", def)
+	}
+
+	matcher := strings.TrimSpace(s[1])
+	m := strings.SplitN(matcher, "=", 2)
+	if len(m) != 2 {
+		return g, fmt.Errorf("invalid process group %q : missing matcher", def)
+	}
+	g, err := NewProcGroup(strings.TrimSpace(s[0]), m[0], m[1])
+	if err != nil {
+		return g, fmt.Errorf("invalid process group %q : %w", def, err)
+	}
+
+	return g, nil
+}
+
+// NewProcGroup : Returns a group of processes whose field, "exe" or "cmdline", is value, or matches value when it is "~regexp"
+func NewProcGroup(name string, field string, value string) (ProcGroup, error) {
+	g := ProcGroup{Name: name, Field: field, Value: value}
+
+	if len(g.Name) == 0 {
+		return g, fmt.Errorf("missing name")
+	}
+	if g.Field != "exe" && g.Field != "cmdline" {
+		return g, fmt.Errorf("unknown field %q", g.Field)
+	}
+	if strings.HasPrefix(g.Value, "~") {
+		g.Value = g.Value[1:]
+		re, err := regexp.Compile(g.Value)
+		if err != nil {
+			return g, err
+		}
+		if _, err := captureNames("procgroup", re); err != nil {
+			return g, err
+		}
+		g.Regexp = re
+	}
+	if len(g.Value) == 0 {
+		return g, fmt.Errorf("empty value")
+	}
+
+	return g, nil
+}
+
+// Match : Returns true if the process belongs to the group
+func (g ProcGroup) Match(p Process) bool {
+	ok, _ := g.match(p)
+	return ok
+}
+
+// Returns true if the process belongs to the group, with values of named capture groups
+func (g ProcGroup) match(p Process) (bool, map[string]string) {
+	value := p.Name
+	if g.Field == "cmdline" {
+		value = p.CmdLine
+	}
+	if g.Regexp != nil {
+		m := g.Regexp.FindStringSubmatch(value)
+		if m == nil {
+			return false, nil
+		}
+		return true, captureValues(g.Regexp, m)
+	}
+	return value == g.Value, nil
+}
+
+// Returns names of capture groups of the group regexp
+func (g ProcGroup) captureNames() []string {
+	if g.Regexp == nil {
+		return nil
+	}
+	names, _ := captureNames("procgroup", g.Regexp)
+	return names
+}
+
+// Identifies a group resource by group name and capture values
+func procGroupKey(name string, captures map[string]string) string {
+	key := name
+	names := make([]string, 0, len(captures))
+	for n := range captures {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		key += "\x00" + n + "=" + captures[n]
+	}
+	return key
+}
+
+// Returns one resource per group name and values of its capture groups, with usage of its processes summed.
+// A process belongs to the first group matching it. Processes exiting before their usage is read are not counted.
+// Groups without capture groups are returned even when no process matches.
+func getProcGroupResources(src RacctSource, groups []ProcGroup, workers int) ([]Resource, error) {
+	var resources []Resource
+	var procs []Resource
+
+	processList, err := src.Processes()
+	if err != nil {
+		return resources, err
+	}
+
+	// Groups defined several times with the same name are merged
+	byKey := make(map[string]int)
+	addGroup := func(name string, captures map[string]string) int {
+		key := procGroupKey(name, captures)
+		if i, ok := byKey[key]; ok {
+			return i
+		}
+		byKey[key] = len(resources)
+		resources = append(resources, Resource{
+			ResourceType:  RESRC_PROCGROUP,
+			ResourceID:    name,
+			ProcGroupName: name,
+			Captures:      captures,
+			Usage:         make(map[ResourceName]int64),
+		})
+		return len(resources) - 1
+	}
+	for _, g := range groups {
+		if len(g.captureNames()) == 0 {
+			addGroup(g.Name, nil)
+		}
+	}
+
+	// Group resource of each process resource, by index
+	var procGroup []int
+	for _, p := range processList {
+		for _, g := range groups {
+			if ok, captures := g.match(p); ok {
+				procs = append(procs, Resource{rule: fmt.Sprintf("process:%d", p.Pid), ResourceID: strconv.Itoa(p.Pid)})
+				procGroup = append(procGroup, addGroup(g.Name, captures))
+				break
+			}
+		}
+	}
+
+	if err := sumProcessesUsage(src, procs, procGroup, resources, workers); err != nil {
+		return nil, err
+	}
+
+	return resources, nil
+}
+
+// Reads usage of processes, and adds it to the resource of each process, whose index is in into.
+// Limits are per process, so only usage is read. Processes exiting before their usage is read are not counted.
+func sumProcessesUsage(src RacctSource, procs []Resource, into []int, resources []Resource, workers int) error {
+	errs := forEachResource(procs, workers, func(r *Resource) error {
+		usage, err := getResourceUsage(src, r.rule)
+		if err != nil {
+			return err
+		}
+		r.Usage = usage.Usage
+		return nil
+	})
+
+	for i, p := range procs {
+		if errs[i] != nil {
+			if errors.Is(errs[i], syscall.ESRCH) {
+				continue
+			}
+			return errs[i]
+		}
+		r := &resources[into[i]]
+		r.NumProcs++
+		for name, v := range p.Usage {
+			r.Usage[name] += v
+		}
+	}
+
+	return nil
+}
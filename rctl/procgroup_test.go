@@ -0,0 +1,101 @@
+package rctl
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func mustParseProcGroups(t *testing.T, defs ...string) []ProcGroup {
+	var groups []ProcGroup
+
+	for _, def := range defs {
+		g, err := ParseProcGroup(def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups = append(groups, g)
+	}
+
+	return groups
+}
+
+func TestParseProcGroupErrors(t *testing.T) {
+	for _, def := range []string{"x", ": exe=a", "a: foo=b", "a: exe", "a: exe=", "a: cmdline=~(", "a: cmdline=~",
+		"a: cmdline=~(?P<group>x)", "a: cmdline=~(?P<__x>x)"} {
+		if _, err := ParseProcGroup(def); err == nil {
+			t.Errorf("ParseProcGroup(%q) : want an error", def)
+		}
+	}
+}
+
+func TestGetProcGroupResources(t *testing.T) {
+	f := NewFakeSource()
+	f.ProcessList = []Process{
+		{Pid: 1, Name: "postgres", CmdLine: "postgres -D /var/db/postgres"},
+		{Pid: 2, Name: "postgres", CmdLine: "postgres: checkpointer"},
+		{Pid: 3, Name: "java", CmdLine: "java -jar billing.jar"},
+		{Pid: 4, Name: "java", CmdLine: "java -jar shop.jar"},
+		{Pid: 5, Name: "java", CmdLine: "java -Xmx1g -jar shop.jar"},
+		{Pid: 6, Name: "postgres", CmdLine: "postgres: exiting"},
+		{Pid: 7, Name: "psql", CmdLine: "psql"},
+	}
+	f.Usage["process:1"] = "memoryuse=10,pcpu=1"
+	f.Usage["process:2"] = "memoryuse=20"
+	f.Usage["process:3"] = "memoryuse=100"
+	f.Usage["process:4"] = "memoryuse=200"
+	f.Usage["process:5"] = "memoryuse=300"
+	f.Usage["process:7"] = "memoryuse=5"
+	// Process 6 exits before its usage is read
+	f.Errors["process:6"] = syscall.ESRCH
+
+	groups := mustParseProcGroups(t,
+		// First group matching a process wins, postgres processes are not in "all"
+		"db: exe=postgres",
+		`java: cmdline=~-jar (?P<app>\w+)\.jar`,
+		// Merged with the first db group
+		"db: exe=psql",
+		// Matches every process, but all of them are in previous groups
+		"all: cmdline=~.",
+		// Exported with no process
+		"none: exe=nginx",
+	)
+	resources, err := getProcGroupResources(f, groups, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type group struct {
+		name     string
+		captures map[string]string
+		numProcs int
+		memory   int64
+	}
+	var got []group
+	for _, r := range resources {
+		if r.ResourceType != RESRC_PROCGROUP || r.ResourceID != r.ProcGroupName {
+			t.Errorf("%s : got type %d, id %s", r.ProcGroupName, r.ResourceType, r.ResourceID)
+		}
+		got = append(got, group{r.ProcGroupName, r.Captures, r.NumProcs, r.Usage["memoryuse"]})
+	}
+	want := []group{
+		{"db", nil, 3, 35},
+		{"all", nil, 0, 0},
+		{"none", nil, 0, 0},
+		// Groups with capture groups get one series per capture values, once a process matches
+		{"java", map[string]string{"app": "billing"}, 1, 100},
+		{"java", map[string]string{"app": "shop"}, 2, 500},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %+v, want %+v", got, want)
+	}
+	if pcpu := resources[0].Usage["pcpu"]; pcpu != 1 {
+		t.Errorf("db : got pcpu %d, want 1", pcpu)
+	}
+
+	// Other errors fail the groups
+	f.Errors["process:6"] = syscall.EPERM
+	if _, err := getProcGroupResources(f, groups, 2); err == nil {
+		t.Error("want an error for EPERM")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020, johan@nosd.in
+//
+// Process trees, whose usage is the sum of a process and all its descendants
+package rctl
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Returns one resource per tree, rooted at processes matching filter, with usage of the tree summed.
+// A matching process descendant of another one is part of its ancestor tree, and does not root its own.
+func getProcTreeResources(src RacctSource, sel Selector, re *regexp.Regexp, workers int) ([]Resource, error) {
+	var resources []Resource
+
+	processList, err := src.Processes()
+	if err != nil {
+		return resources, err
+	}
+	roots, err := matchProcesses(src, processList, "process", sel, re)
+	if err != nil {
+		return resources, err
+	}
+
+	ppids := make(map[int]int)
+	children := make(map[int][]int)
+	for _, p := range processList {
+		ppids[p.Pid] = p.PPid
+		// PID 0 is its own parent
+		if p.PPid != p.Pid {
+			children[p.PPid] = append(children[p.PPid], p.Pid)
+		}
+	}
+	matched := make(map[int]bool)
+	for _, r := range roots {
+		pid, _ := strconv.Atoi(r.ResourceID)
+		matched[pid] = true
+	}
+
+	var procs []Resource
+	var procTree []int
+	// A process is counted once, even if a PID was reused while processes were listed and parents form a loop
+	visited := make(map[int]bool)
+	for _, r := range roots {
+		pid, _ := strconv.Atoi(r.ResourceID)
+		if hasMatchedAncestor(pid, ppids, matched) {
+			continue
+		}
+
+		r.ResourceType = RESRC_PROCTREE
+		r.Usage = make(map[ResourceName]int64)
+		resources = append(resources, r)
+
+		// Walk the tree, root first
+		for todo := []int{pid}; len(todo) > 0; todo = todo[1:] {
+			if visited[todo[0]] {
+				continue
+			}
+			visited[todo[0]] = true
+			procs = append(procs, Resource{rule: fmt.Sprintf("process:%d", todo[0]), ResourceID: strconv.Itoa(todo[0])})
+			procTree = append(procTree, len(resources)-1)
+			todo = append(todo, children[todo[0]]...)
+		}
+	}
+
+	if err := sumProcessesUsage(src, procs, procTree, resources, workers); err != nil {
+		return nil, err
+	}
+
+	return resources, nil
+}
+
+// Returns true if an ancestor of pid is matched
+func hasMatchedAncestor(pid int, ppids map[int]int, matched map[int]bool) bool {
+	seen := map[int]bool{pid: true}
+	for {
+		ppid, ok := ppids[pid]
+		if !ok || seen[ppid] {
+			return false
+		}
+		if matched[ppid] {
+			return true
+		}
+		seen[ppid] = true
+		pid = ppid
+	}
+}
@@ -0,0 +1,84 @@
+package rctl
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestGetProcTreeResources(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "nginx.pid")
+	if err := os.WriteFile(pidfile, []byte("20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFakeSource()
+	f.ProcessList = []Process{
+		// PID 0 is its own parent
+		{Pid: 0, PPid: 0, Name: "kernel"},
+		{Pid: 1, PPid: 0, Name: "init", CmdLine: "/sbin/init"},
+		{Pid: 10, PPid: 1, Name: "nginx", CmdLine: "nginx: master process"},
+		{Pid: 11, PPid: 10, Name: "nginx", CmdLine: "nginx: worker process"},
+		{Pid: 12, PPid: 10, Name: "nginx", CmdLine: "nginx: worker process"},
+		{Pid: 13, PPid: 12, Name: "sh", CmdLine: "sh -c true"},
+		{Pid: 14, PPid: 12, Name: "sh", CmdLine: "sh -c exit"},
+		{Pid: 20, PPid: 1, Name: "nginx", CmdLine: "nginx: master process"},
+		// Parents listed as a loop, as when a PID is reused while processes are listed
+		{Pid: 30, PPid: 31, Name: "loop", CmdLine: "loop"},
+		{Pid: 31, PPid: 30, Name: "loop", CmdLine: "loop child"},
+	}
+	for _, p := range f.ProcessList {
+		f.Usage["process:"+strconv.Itoa(p.Pid)] = "memoryuse=1,cputime=2"
+	}
+	// Process 14 exits while the tree is walked
+	delete(f.Usage, "process:14")
+
+	tests := []struct {
+		filter string
+		want   map[string]int // Number of processes by root PID
+	}{
+		// Workers matching are in the tree of their master
+		{"^nginx", map[string]int{"10": 4, "20": 1}},
+		{"^nginx: worker", map[string]int{"11": 1, "12": 2}},
+		{"pid=10", map[string]int{"10": 4}},
+		{"pidfile=" + pidfile, map[string]int{"20": 1}},
+		{"pidfile=" + pidfile + ".missing", map[string]int{}},
+		// Every process but the exited one and the loop, the kernel included
+		{"pid=0", map[string]int{"0": 7}},
+		{"^loop$", map[string]int{"30": 2}},
+	}
+
+	for _, tt := range tests {
+		sel, re, err := parseProcessFilter("proctree", tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources, err := getProcTreeResources(f, sel, re, 2)
+		if err != nil {
+			t.Errorf("%s : unexpected error %v", tt.filter, err)
+			continue
+		}
+		got := make(map[string]int)
+		for _, r := range resources {
+			if r.ResourceType != RESRC_PROCTREE {
+				t.Errorf("%s : got type %d for %s", tt.filter, r.ResourceType, r.ResourceID)
+			}
+			if r.Usage["memoryuse"] != int64(r.NumProcs) || r.Usage["cputime"] != 2*int64(r.NumProcs) {
+				t.Errorf("%s : got usage %v for %d processes", tt.filter, r.Usage, r.NumProcs)
+			}
+			got[r.ResourceID] = r.NumProcs
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s : got trees %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	f.Errors["process:13"] = syscall.EPERM
+	if _, err := getProcTreeResources(f, nil, regexp.MustCompile("^nginx"), 2); err == nil {
+		t.Error("want an error for EPERM")
+	}
+}
@@ -1,38 +1,31 @@
 // Copyright 2020, johan@nosd.in
-// +build freebsd
 //
-// Use libjail.so to get/set jail params
+// Collect RACCT resources usage of processes, users, jails and login classes
 package rctl
 
-/*
-#cgo CFLAGS: -I /usr/lib
-#cgo LDFLAGS: -L. -ljail -lc
-#include <stdlib.h>
-#include <jail.h>
-#include <utmpx.h>
-#include <pwd.h>
-*/
-import "C"
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
-	"unsafe"
+	"time"
 
-	"golang.org/x/sys/unix"
-	ps "github.com/yo000/go-ps"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	GLog *logrus.Logger
+	// Logger of the package, replaced by the one passed to the first NewResourceManager
+	GLog     = logrus.StandardLogger()
+	glogOnce sync.Once
 
 	// Supported rctl subjects
 	SUPPORTED_SUBJECTS = []string{"process", "user", "loginclass", "jail"}
+	// Subjects of filters, proctree is only known by the exporter
+	FILTER_SUBJECTS = []string{"process", "user", "loginclass", "jail", "proctree"}
 )
 
 const (
@@ -40,9 +33,20 @@ const (
 	RESRC_USER       = 2
 	RESRC_LOGINCLASS = 3
 	RESRC_JAIL       = 4
+	// Usage of an ancestor of collected jails, including all its children, see rollupJails
+	RESRC_JAIL_ROLLUP = 5
+	// Usage of a group of processes, see ProcGroup
+	RESRC_PROCGROUP = 6
+	// Usage of a process and its descendants, see getProcTreeResources
+	RESRC_PROCTREE = 7
+
+	// Concurrent usage lookups when not configured
+	DEFAULT_WORKERS = 4
 
 	// copied from sys/syscall.h
-	SYS_RCTL_GET_RACCT = 525
+	SYS_RCTL_GET_RACCT  = 525
+	SYS_RCTL_GET_RULES  = 526
+	SYS_RCTL_GET_LIMITS = 527
 
 	// From utmpx.h
 	USER_PROCESS = 4 /* A process. */
@@ -50,155 +54,407 @@ const (
 
 // Resource : Represent a resource and its usage as reported by rctl(8)
 type Resource struct {
-	ResourceType    int    // Resource type : process, jail, loginclass or user
-	ResourceID      string // Resource identifier : PID, UID, jail name or loginclass from login.conf
-	ProcessPPid     int    // For process type, this is the PPID
-	ProcessCmdLine  string // For process type, this is the full command line with path and args
-	ProcessName     string // For process type, this is the binary name
-	UserName        string // For user type, this is the username
-	JailName        string // For jail type, this is the jail name as seen by "jls -N" (JID column)
-	LoginClassName  string // For loginclass type, this is the loginclass name as in login.conf
-	RawResources    string // Raw string resources, as returned by rctl binary
-	CPUTime         int    // CPU time, in seconds
-	DataSize        int    // data size, in bytes
-	StackSize       int    // stack size, in bytes
-	CoreDumpSize    int    // core dump size, in bytes
-	MemoryUse       int    // resident set size, in bytes
-	MemoryLocked    int    // locked memory, in bytes
-	MaxProc         int    // number of processes
-	OpenFiles       int    // file descriptor table size
-	VMemoryUse      int    // address space limit, in bytes
-	PseudoTerminals int    // number of PTYs
-	SwapUse         int    // swap space that may be reserved or used, in bytes
-	NThr            int    // number of threads
-	MsgQQueued      int    // number of queued SysV messages
-	MsgQSize        int    // SysV message queue size, in bytes
-	NMsgQ           int    // number of SysV message queues
-	NSem            int    // number of SysV semaphores
-	NSemop          int    // number of SysV semaphores modified in a single semop(2) call
-	NShm            int    // number of SysV shared memory segments
-	ShmSize         int    // SysV shared memory size, in bytes
-	WallClock       int    // wallclock time, in seconds
-	PCpu            int    // %CPU, in percents of a single CPU core
-	ReadBps         int    // filesystem reads, in bytes per second
-	WriteBps        int    // filesystem writes, in bytes per second
-	ReadIops        int    // filesystem reads, in operations per seconds
-	WriteIops       int    // filesystem writes, in operations per seconds
+	ResourceType     int                    // Resource type : process, jail, loginclass or user
+	ResourceID       string                 // Resource identifier : PID, UID, JID or loginclass from login.conf
+	ProcessPPid      int                    // For process type, this is the PPID
+	ProcessCmdLine   string                 // For process type, this is the full command line with path and args
+	ProcessName      string                 // For process type, this is the binary name
+	UserName         string                 // For user type, this is the username
+	JailName         string                 // For jail type, this is the jail name as seen by "jls -N" (JID column)
+	JailParams       Jail                   // For jail type, jail parameters as returned by libjail
+	JailParent       string                 // For jail type, name of the parent jail, empty for jails created on the host
+	LoginClassName   string                 // For loginclass type, this is the loginclass name as in login.conf
+	LoginClassLimits map[ResourceName]int64 // For loginclass type, resource limits set in login.conf
+	UserLoginClass   string                 // For user type, login class of the user from master.passwd
+	ProcGroupName    string                 // For procgroup type, name of the group
+	NumProcs         int                    // For procgroup and proctree types, number of processes summed
+	Captures         map[string]string      // For process and procgroup types, values of named capture groups of the matching regexp
+	RawResources     string                 // Raw string resources, as returned by rctl binary
+	Usage            map[ResourceName]int64 // Usage by resource name, including resources missing from KnownResources
+	Limits           []Rule                 // Rules applying to this resource
+	rule             string                 // rctl filter used to get usage and limits
 }
 
-// ResourceMgr : Contains resources filters and an array of resources
+// ResourceNames : Returns names of resources with a usage, sorted
+func (r Resource) ResourceNames() []ResourceName {
+	names := make([]ResourceName, 0, len(r.Usage))
+	for name := range r.Usage {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+	return names
+}
+
+// ResourceMgr : Contains resources filters and the last snapshot of their usage
 type ResourceMgr struct {
-	resrcesfilter []string
+	resrcesfilter []filter
+	source        RacctSource
 	log           *logrus.Logger
-	Resources     []Resource
+	Workers       int           // Number of concurrent usage lookups
+	Limits        bool          // Also collect rctl rules applying to collected items
+	JailRollup    bool          // Also export usage of ancestors of collected jails, see rollupJails
+	Users         UserSelection // Where users are enumerated from
+	ProcGroups    []ProcGroup   // Groups of processes whose usage is summed
+
+	// Held by refreshes while they read the filters and fields above, see Reconfigure
+	cfgMu sync.RWMutex
+
+	// Protects fields below, which are replaced by refreshes
+	mu        sync.RWMutex
+	snapshot  *Snapshot
+	interval  time.Duration       // Background refresh interval, 0 when refreshed by caller
+	succeeded time.Time           // End of the last refresh where a filter succeeded, see Stale
+	errCounts map[ErrorKey]uint64 // Failures since the manager was created
+}
+
+// Snapshot : Resources usage collected by a refresh. A snapshot is never modified once returned,
+// so it can be read by concurrent scrapes.
+type Snapshot struct {
+	Time      time.Time                // End of the refresh
+	Resources []Resource               // Resources of subjects collected without error
+	Durations map[string]time.Duration // Time spent collecting each subject
+	Errors    map[string]error         // Error of each subject which failed
+	Labels    map[string][]string      // Names of capture groups of process and procgroup regexps, by subject
+	Filters   []FilterResult           // Outcome of each filter, process groups and jail rollup
+	ErrCounts map[ErrorKey]uint64      // Failures since the manager was created, including this refresh
 }
 
-type user struct {
-	name string
-	uid  int
+// FilterResult : Outcome of a filter during a refresh
+type FilterResult struct {
+	Subject string
+	Filter  string // Filter as configured, e.g. "!jail:^build-", empty for process groups and jail rollup
+	Err     error  // nil when the filter was collected
+}
+
+// ErrorKey : Identifies a kind of failure, by subject and errno name, e.g. "EPERM" or "other"
+type ErrorKey struct {
+	Subject string
+	Errno   string
+}
+
+// Err : Returns an error summarizing subjects errors, nil if all subjects were collected
+func (s *Snapshot) Err() error {
+	if len(s.Errors) == 0 {
+		return nil
+	}
+
+	var msgs []string
+	for subject, err := range s.Errors {
+		msgs = append(msgs, subject+": "+err.Error())
+	}
+	sort.Strings(msgs)
+
+	return errors.New(strings.Join(msgs, ", "))
 }
 
-type jail struct {
-	name string
-	jid  int
+// AllFailed : Returns true if there was something to collect, and all of it failed
+func (s *Snapshot) AllFailed() bool {
+	for _, f := range s.Filters {
+		if f.Err == nil {
+			return false
+		}
+	}
+	return len(s.Filters) > 0
 }
 
-// Refresh : Refreshes resources usage
-func (r *ResourceMgr) Refresh() (*ResourceMgr, error) {
+// Refresh : Refreshes resources usage, and returns the new snapshot.
+// A filter failing does not prevent others to be collected, its error is in the snapshot.
+// Items disappearing during the refresh, like exiting processes, are skipped.
+func (r *ResourceMgr) Refresh() (*Snapshot, error) {
 	var results []Resource
-	var err error
+	var filterResults []FilterResult
+
+	r.cfgMu.RLock()
+	defer r.cfgMu.RUnlock()
+
+	durations := make(map[string]time.Duration)
+	errs := make(map[string]error)
+	errCounts := make(map[ErrorKey]uint64)
+
+	// Rules of users, jails and login classes are read once, processes limits are read per process
+	var rules ruleIndex
+	if r.Limits {
+		rules = readRules(r.source)
+	}
 
-	//// First, flush previous results to clear RAM
-	//for _, resrc := range r.Resources {
-	//	if resrc.ResourceType == RESRC_PROCESS {
-	//		resrc.ProcessCmdLine = nil
-	//	}
-	//}
+	report := func(subject string, text string, err error) {
+		filterResults = append(filterResults, FilterResult{Subject: subject, Filter: text, Err: err})
+		if err != nil {
+			errs[subject] = err
+			errCounts[ErrorKey{Subject: subject, Errno: errnoName(err)}]++
+		}
+	}
 
-	for _, resrcFilter := range r.resrcesfilter {
-		// split 2 first words, so resrcFilter value can contains ':'
-		s := strings.SplitN(resrcFilter, ":", 2)
-		subject, filter := s[0], s[1]
+	// Subjects matched by exclude filters, and already collected, as "subject:ID"
+	excluded, excludeFailed := r.excludedResources(durations, report)
+	seen := make(map[string]bool)
 
+	for _, f := range r.resrcesfilter {
+		if f.exclude {
+			continue
+		}
+		subject := f.subject
+		start := time.Now()
+
+		// Without its exclusions, a subject is not collected
+		if err, ok := excludeFailed[subject]; ok {
+			report(subject, f.text, fmt.Errorf("not collected, an exclude filter failed : %w", err))
+			continue
+		}
+
+		// First list subjects matching filter...
+		var res []Resource
+		var err error
 		if subject == "process" {
-			res, err := getProcessResources(subject, filter)
-			if err != nil {
-				return r, err
-			}
-			results = append(results, res...)
+			res, err = getProcessResources(r.source, subject, f.sel, f.re)
 		} else if subject == "user" {
-			res, err := getUserResources(subject, filter)
-			if err != nil {
-				return r, err
-			}
-			results = append(results, res...)
+			res, err = getUserResources(r.source, subject, f.re, r.Users)
 		} else if subject == "loginclass" {
-			res, err := getLoginClassResources(subject, filter)
-			if err != nil {
-				return r, err
-			}
-			results = append(results, res...)
+			res, err = getLoginClassResources(r.source, subject, f.re)
 		} else if subject == "jail" {
-			res, err := getJailResources(subject, filter)
-			if err != nil {
-				return r, err
+			res, err = getJailResources(r.source, subject, f.re)
+		} else if subject == "proctree" {
+			// Trees usage is summed while they are walked
+			res, err = getProcTreeResources(r.source, f.sel, f.re, r.Workers)
+		}
+
+		// ...drop excluded ones and those matched by a previous filter...
+		kept := res[:0]
+		for _, rs := range res {
+			key := subject + ":" + rs.ResourceID
+			if excluded[key] || seen[key] {
+				continue
 			}
-			results = append(results, res...)
+			seen[key] = true
+			kept = append(kept, rs)
+		}
+		res = kept
+
+		// ...then get their usage, one syscall per subject
+		if err == nil && subject != "proctree" {
+			res, err = fetchResources(r.source, res, r.Workers, rules)
 		}
+		durations[subject] += time.Since(start)
+		report(subject, f.text, err)
+		if err != nil {
+			r.log.Errorf("Error collecting %s : %v", f.text, err)
+			continue
+		}
+		results = append(results, res...)
 	}
 
-	r.Resources = results
+	if len(r.ProcGroups) > 0 {
+		start := time.Now()
+		groups, err := getProcGroupResources(r.source, r.ProcGroups, r.Workers)
+		durations["procgroup"] += time.Since(start)
+		report("procgroup", "", err)
+		if err != nil {
+			r.log.Errorf("Error collecting process groups : %v", err)
+		} else {
+			results = append(results, groups...)
+		}
+	}
+
+	if r.JailRollup {
+		start := time.Now()
+		rollups, err := rollupJails(r.source, results, r.Workers)
+		durations["jail"] += time.Since(start)
+		report("jail_rollup", "", err)
+		if err != nil {
+			r.log.Errorf("Error rolling up jails usage : %v", err)
+		} else {
+			results = append(results, rollups...)
+		}
+	}
 
-	return r, err
+	snap := &Snapshot{Time: time.Now(), Resources: results, Durations: durations, Errors: errs, Labels: r.captureLabels(),
+		Filters: filterResults}
+
+	r.mu.Lock()
+	if r.errCounts == nil {
+		r.errCounts = make(map[ErrorKey]uint64)
+	}
+	// Snapshots keep their own copy, as counts go on with next refreshes
+	snap.ErrCounts = make(map[ErrorKey]uint64)
+	for k, n := range errCounts {
+		r.errCounts[k] += n
+	}
+	for k, n := range r.errCounts {
+		snap.ErrCounts[k] = n
+	}
+	r.snapshot = snap
+	if !snap.AllFailed() {
+		r.succeeded = snap.Time
+	}
+	r.mu.Unlock()
+
+	return snap, snap.Err()
 }
 
-// Check rule subject is valid and supported
-func checkSubject(rule string) (string, error) {
-	s := strings.Split(rule, ":")
+// Lists resources matched by exclude filters such as "!jail:^build-", as "subject:ID", and errors of subjects whose
+// exclude filters failed. Their usage is not read, and a proctree exclude filter excludes trees rooted at matching processes.
+func (r *ResourceMgr) excludedResources(durations map[string]time.Duration, report func(string, string, error)) (map[string]bool, map[string]error) {
+	excluded := make(map[string]bool)
+	failed := make(map[string]error)
 
-	for _, v := range SUPPORTED_SUBJECTS {
-		if v == s[0] {
-			return s[0], nil
+	for _, f := range r.resrcesfilter {
+		if !f.exclude {
+			continue
+		}
+		subject := f.subject
+		start := time.Now()
+
+		var res []Resource
+		var err error
+		if subject == "process" || subject == "proctree" {
+			res, err = getProcessResources(r.source, "process", f.sel, f.re)
+		} else if subject == "user" {
+			res, err = getUserResources(r.source, subject, f.re, r.Users)
+		} else if subject == "loginclass" {
+			res, err = getLoginClassResources(r.source, subject, f.re)
+		} else if subject == "jail" {
+			res, err = getJailResources(r.source, subject, f.re)
+		}
+
+		durations[subject] += time.Since(start)
+		report(subject, f.text, err)
+		if err != nil {
+			r.log.Errorf("Error collecting %s : %v", f.text, err)
+			failed[subject] = err
+			continue
+		}
+		for _, rs := range res {
+			excluded[subject+":"+rs.ResourceID] = true
 		}
 	}
 
-	return "", errors.New("subject not supported")
+	return excluded, failed
 }
 
-// Appel du syscall sys_rctl_get_racct implémenté dans sys/kern/kern_rctl.c:1609
-// Le corps de fonction est copié de https://go.googlesource.com/go/+/refs/tags/go1.15.3/src/syscall/zsyscall_freebsd_amd64.go
-func rctlGetRacct(rule string) (string, error) {
-	var result string
+// Returns the union of capture group names of process and proctree filters and process groups regexps, by subject.
+// Metrics of a subject get all these labels, empty when their regexp does not have the group.
+// Exclude filters are left out, as the items they match are not exported.
+func (r *ResourceMgr) captureLabels() map[string][]string {
+	labels := make(map[string][]string)
 
-	_rule, err := unix.BytePtrFromString(rule)
-	if err != nil {
-		return result, err
+	for _, f := range r.resrcesfilter {
+		if (f.subject != "process" && f.subject != "proctree") || f.re == nil || f.exclude {
+			continue
+		}
+		if names, err := captureNames(f.subject, f.re); err == nil {
+			labels[f.subject] = mergeCaptureNames(labels[f.subject], names)
+		}
+	}
+	for _, g := range r.ProcGroups {
+		labels["procgroup"] = mergeCaptureNames(labels["procgroup"], g.captureNames())
 	}
 
-	// FIXME: 1024bytes should be enough for anybody
-	_out := make([]byte, 1024)
+	return labels
+}
+
+// Snapshot : Returns the snapshot of the last refresh, nil before the first one
+func (r *ResourceMgr) Snapshot() *Snapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.snapshot
+}
 
-	_, _, e1 := syscall.Syscall6(SYS_RCTL_GET_RACCT, uintptr(unsafe.Pointer(_rule)),
-		uintptr(len(rule)+1), uintptr(unsafe.Pointer(&_out[0])),
-		uintptr(len(_out)), 0, 0)
-	if e1 != 0 {
-		GLog.Error("syscall rctl_get_racct returned an error : ", e1)
-		// 78 = "RACCT/RCTL present, but disabled; enable using kern.racct.enable=1 tunable"
-		return string(_out), e1
+// Gets usage and limits of resources, with up to workers concurrent lookups.
+// resources are filled in place, so their order does not depend on lookups completion.
+// Items which disappeared since they were listed, like exited processes, are dropped from the returned resources.
+func fetchResources(src RacctSource, resources []Resource, workers int, rules ruleIndex) ([]Resource, error) {
+	errs := forEachResource(resources, workers, func(r *Resource) error {
+		return fetchResource(src, r, rules)
+	})
+
+	kept := resources[:0]
+	for i, err := range errs {
+		if errors.Is(err, syscall.ESRCH) {
+			GLog.Debug("Skipped " + resources[i].rule + " : it disappeared before its usage was read")
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, resources[i])
 	}
 
-	var i int
-	for i, _ = range _out {
-		if _out[i] == 0 {
-			break
+	return kept, nil
+}
+
+// Calls fetch on each resource, with up to workers concurrent calls. Returns errors by resource index.
+func forEachResource(resources []Resource, workers int, fetch func(*Resource) error) []error {
+	var wg sync.WaitGroup
+
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(resources) {
+		workers = len(resources)
+	}
+
+	errs := make([]error, len(resources))
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = fetch(&resources[i])
+			}
+		}()
+	}
+	for i := range resources {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return errs
+}
+
+// Gets usage and limits of one resource
+func fetchResource(src RacctSource, r *Resource, rules ruleIndex) error {
+	usage, err := getResourceUsage(src, r.rule)
+	if err != nil {
+		// Processes exiting while they are collected are expected
+		if !errors.Is(err, syscall.ESRCH) {
+			GLog.Errorf("Error while getting resource usage for rule %s : %v", r.rule, err)
 		}
+		return err
 	}
+	r.ResourceType = usage.ResourceType
+	r.RawResources = usage.RawResources
+	r.Usage = usage.Usage
 
-	//https://go101.org/article/memory-leaking.html
-	//result = append([]byte(nil), _out[:i])
-	//return string(result), nil
+	// Limits are not collected
+	if rules == nil {
+		GLog.Debug("Added " + r.rule + " with resources : " + r.RawResources)
+		return nil
+	}
+	r.Limits, err = getLimits(src, r.rule, rules)
+	if err != nil {
+		GLog.Debug("Could not get limits for rule " + r.rule + " : " + err.Error())
+	}
+
+	GLog.Debug("Added " + r.rule + " with resources : " + r.RawResources)
 
-	return string(_out[0:i]), nil
+	return nil
+}
+
+// Check rule subject is valid and supported
+func checkSubject(rule string) (string, error) {
+	s := strings.Split(rule, ":")
+
+	for _, v := range SUPPORTED_SUBJECTS {
+		if v == s[0] {
+			return s[0], nil
+		}
+	}
+
+	return "", errors.New("subject not supported")
 }
 
 // Parses rctl_get_racct return to fill Resource structure
@@ -221,106 +477,38 @@ func parseResource(subject string, resrc string) Resource {
 	// Save raw result...
 	result.RawResources = resrc
 
-	// ...then parse into fields
+	// ...then parse into usage map
+	result.Usage = make(map[ResourceName]int64)
 	for _, r := range strings.Split(resrc, ",") {
-		s := strings.Split(r, "=")
+		s := strings.SplitN(r, "=", 2)
 		if len(s) != 2 {
-			return result
-		}
-		if s[0] == "cputime" {
-			result.CPUTime, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "datasize" {
-			result.DataSize, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "stacksize" {
-			result.StackSize, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "coredumpsize" {
-			result.CoreDumpSize, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "memoryuse" {
-			result.MemoryUse, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "memorylocked" {
-			result.MemoryLocked, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "maxproc" {
-			result.MaxProc, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "openfiles" {
-			result.OpenFiles, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "vmemoryuse" {
-			result.VMemoryUse, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "pseudoterminals" {
-			result.PseudoTerminals, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "swapuse" {
-			result.SwapUse, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "nthr" {
-			result.NThr, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "msgqqueued" {
-			result.MsgQQueued, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "msgqsize" {
-			result.MsgQSize, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "nmsgq" {
-			result.NMsgQ, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "nsem" {
-			result.NSem, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "nsemop" {
-			result.NSemop, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "nshm" {
-			result.NShm, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "shmsize" {
-			result.ShmSize, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "wallclock" {
-			result.WallClock, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "pcpu" {
-			result.PCpu, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "readbps" {
-			result.ReadBps, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "writebps" {
-			result.WriteBps, _ = strconv.Atoi(s[1])
-		}
-		if s[0] == "readiops" {
-			result.ReadIops, _ = strconv.Atoi(s[1])
+			continue
 		}
-		if s[0] == "writeiops" {
-			result.WriteIops, _ = strconv.Atoi(s[1])
+		v, err := strconv.ParseInt(s[1], 10, 64)
+		if err != nil {
+			GLog.Error("Error parsing " + s[1] + ", value of " + s[0] + " into int : " + err.Error())
+			continue
 		}
+		result.Usage[ResourceName(s[0])] = v
 	}
 
 	return result
 }
 
 // Returns resources usage as a raw string
-func getRawResourceUsage(rule string) (string, error) {
+func getRawResourceUsage(src RacctSource, rule string) (string, error) {
 	_, err := checkSubject(rule)
 	if err != nil {
 		return "", err
 	}
 
-	buf, err := rctlGetRacct(rule)
+	buf, err := src.GetRacct(rule)
 
 	return buf, err
 }
 
 // Returns resources usage as a structure which can be used to pick resources
-func getResourceUsage(rule string) (Resource, error) {
+func getResourceUsage(src RacctSource, rule string) (Resource, error) {
 	var result Resource
 
 	subject, err := checkSubject(rule)
@@ -328,7 +516,7 @@ func getResourceUsage(rule string) (Resource, error) {
 		return result, err
 	}
 
-	buf, err := rctlGetRacct(rule)
+	buf, err := src.GetRacct(rule)
 	if err != nil {
 		return result, err
 	}
@@ -341,283 +529,156 @@ func getResourceUsage(rule string) (Resource, error) {
 }
 
 // Get Resources for a process, then glue process informations to Resource structure
-func getProcessResources(subject string, filter string) ([]Resource, error) {
+func getProcessResources(src RacctSource, subject string, sel Selector, re *regexp.Regexp) ([]Resource, error) {
 	var results []Resource
-	var err error
 
-	re, err := regexp.Compile(filter)
+	processList, err := src.Processes()
 	if err != nil {
-		GLog.Fatal("rctlCollect %s do not compile", filter)
+		GLog.Error("Listing processes failed with the following:")
+		GLog.Errorf("%v", err)
+		return results, err
+	}
+
+	return matchProcesses(src, processList, subject, sel, re)
+}
+
+// Process filters are either a selector on process attributes, or a regexp matched on the command line
+func parseProcessFilter(subject string, filter string) (Selector, *regexp.Regexp, error) {
+	if IsSelector(filter) {
+		sel, err := ParseSelector(filter)
+		return sel, nil, err
 	}
 
-	processList, err := ps.Processes()
+	re, err := regexp.Compile(filter)
 	if err != nil {
-		GLog.Error("ps.Processes() Failed with the following:")
-		GLog.Error("%v", err)
-		return results, err
+		return nil, nil, err
+	}
+	if _, err := captureNames(subject, re); err != nil {
+		return nil, nil, err
+	}
+
+	return nil, re, nil
+}
+
+// Returns resources of processes matching a selector or a command line regexp
+func matchProcesses(src RacctSource, processList []Process, subject string, sel Selector, re *regexp.Regexp) ([]Resource, error) {
+	var results []Resource
+	var err error
+
+	var ctx *selectorContext
+	if sel != nil {
+		ctx, err = sel.newContext(src)
+		if err != nil {
+			return results, err
+		}
 	}
 
 	// Allocate an array of 0, to max len(processList)
 	results = make([]Resource, 0, len(processList))
 
 	for _, process := range processList {
-		if len(re.FindString(process.CommandLine())) > 0 {
-			rule := fmt.Sprintf("%s:%d:", subject, process.Pid())
-			r, err := getResourceUsage(rule)
-			if err != nil {
-				GLog.Error("Error while getting resource usage for rule : " + rule)
-				return results, err
+		var match []string
+		matched := false
+		if sel != nil {
+			matched = sel.match(process, ctx)
+		} else {
+			match = re.FindStringSubmatch(process.CmdLine)
+			matched = len(match) > 0 && len(match[0]) > 0
+		}
+		if matched {
+			rule := fmt.Sprintf("%s:%d:", subject, process.Pid)
+			r := Resource{rule: rule}
+			r.ResourceID = strconv.Itoa(process.Pid)
+			r.ProcessPPid = process.PPid
+			r.ProcessName = process.Name
+			r.ProcessCmdLine = process.CmdLine
+			if re != nil {
+				r.Captures = captureValues(re, match)
 			}
-			r.ResourceID = strconv.Itoa(process.Pid())
-			r.ProcessPPid = process.PPid()
-			r.ProcessName = process.Executable()
-			r.ProcessCmdLine = process.CommandLine()
 			results = append(results, r)
-			GLog.Debug("Added process " + r.ProcessCmdLine + " with resources : " + r.RawResources)
 		}
 	}
 	return results, err
 }
 
-func containsUser(users []user, name string) bool {
+func containsUser(users []User, name string) bool {
 	for _, a := range users {
-		if a.name == name {
+		if a.Name == name {
 			return true
 		}
 	}
 	return false
 }
 
-// get users from utx database
-func getUsers() ([]user, error) {
-	var utx *C.struct_utmpx
-	var pw *C.struct_passwd
-	var users []user
-
-	// Open active DB
-	C.setutxent()
-
-	for {
-		utx = C.getutxent()
-		if utx == nil {
-			break
-		}
-		if utx.ut_type != USER_PROCESS {
-			continue
-		}
-
-		if containsUser(users, C.GoString(&utx.ut_user[0])) == false {
-			pw = C.getpwnam(&utx.ut_user[0])
-			if pw == nil {
-				errr := fmt.Sprintf("Error caling getpwnam for %s\n", C.GoString(&utx.ut_user[0]))
-				return nil, errors.New(errr)
-			}
-			usr := user{name: C.GoString(&utx.ut_user[0]), uid: int(pw.pw_uid)}
-			users = append(users, usr)
-		}
-		//fmt.Printf("%s\n", C.GoString(&utx.ut_user[0]))
-	}
-
-	// Close utx.active DB
-	C.endutxent()
-
-	return users, nil
-}
-
-// get current users from /etc/passwd
-func getUsersFromPasswd() ([]user, error) {
-	var usr user
-	var usrs []user
-
-	data, err := ioutil.ReadFile("/etc/passwd")
-	if err != nil {
-		return usrs, err
-	}
-	for _, line := range strings.Split(string(data), "\n") {
-		if len(line) > 0 && strings.HasPrefix(string(line), "#") == false {
-			s := strings.Split(string(line), ":")
-			if len(s) > 0 {
-				if strings.Count(string(s[0]), "") > 0 {
-					usr.name = s[0]
-					usr.uid, _ = strconv.Atoi(s[2])
-					GLog.Debug("Appending user " + usr.name + " with UID " + strconv.Itoa(usr.uid))
-					usrs = append(usrs, usr)
-				}
-			}
-		}
-	}
-
-	return usrs, err
-}
-
-func getUserResources(subject string, filter string) ([]Resource, error) {
+func getUserResources(src RacctSource, subject string, re *regexp.Regexp, sel UserSelection) ([]Resource, error) {
 	var resources []Resource
 
-	//usrs, err := getUsersFromPasswd()
-	usrs, err := getUsers()
+	usrs, err := listUsers(src, sel)
 	if err != nil {
 		return resources, err
 	}
-	re, err := regexp.Compile(filter)
-	if err != nil {
-		GLog.Fatal("rctlCollect %s do not compile", filter)
-	}
 
 	for _, usr := range usrs {
-		if len(re.FindString(usr.name)) > 0 {
-			rule := fmt.Sprintf("%s:%d:", subject, usr.uid)
+		if len(re.FindString(usr.Name)) > 0 {
+			rule := fmt.Sprintf("%s:%d:", subject, usr.Uid)
 			GLog.Debug("Rule : " + rule)
-			r, err := getResourceUsage(rule)
-			if err != nil {
-				GLog.Error("Error while getting resource usage for rule : " + rule)
-				return resources, err
-			}
-			r.ResourceID = strconv.Itoa(usr.uid)
-			r.UserName = usr.name
+			r := Resource{rule: rule}
+			r.ResourceID = strconv.Itoa(usr.Uid)
+			r.UserName = usr.Name
+			r.UserLoginClass = usr.Class
 			resources = append(resources, r)
-			GLog.Debug("Added user " + r.UserName + " with resources : " + r.RawResources)
 		}
 	}
 
 	return resources, err
 }
 
-// We can not use jail_getv ou jail_setv because they are variadic C functions (would need a C wrapper)
-func getJails() ([]jail, error) {
-	var jls []jail
-	var jl jail
-	var err error
-
-	params := make([]C.struct_jailparam, 3)
-
-	// initialize parameter names
-	csname := C.CString("name")
-	defer C.free(unsafe.Pointer(csname))
-	csjid := C.CString("jid")
-	defer C.free(unsafe.Pointer(csjid))
-	cslastjid := C.CString("lastjid")
-	defer C.free(unsafe.Pointer(cslastjid))
-
-	// initialize params struct with parameter names
-	C.jailparam_init(&params[0], csname)
-	C.jailparam_init(&params[1], csjid)
-
-	// The key to retrieve jail. lastjid = 0 returns first jail and its jid as jailparam_get return value
-	C.jailparam_init(&params[2], cslastjid)
-
-	lastjailid := 0
-	cslastjidval := C.CString(strconv.Itoa(lastjailid))
-	defer C.free(unsafe.Pointer(cslastjidval))
-
-	C.jailparam_import(&params[2], cslastjidval)
-
-	// loop on existing jails
-	for lastjailid >= 0 {
-		// get parameter values
-		lastjailid = int(C.jailparam_get(&params[0], 3, 0))
-		if lastjailid > 0 {
-			nametmp := C.jailparam_export(&params[0])
-			jl.name = C.GoString(nametmp)
-			// Memory mgmt : Non gere par Go
-			C.free(unsafe.Pointer(nametmp))
-			jidtmp := C.jailparam_export(&params[1])
-			jl.jid, _ = strconv.Atoi(C.GoString(jidtmp))
-			// Memory mgmt : Non gere par Go
-			C.free(unsafe.Pointer(jidtmp))
-			jls = append(jls, jl)
-			//GLog.Debug("Got jid " + strconv.Itoa(jl.jid) + " with name " + jl.name)
-
-			// Prepare next loop iteration
-			cslastjidval := C.CString(strconv.Itoa(lastjailid))
-			defer C.free(unsafe.Pointer(cslastjidval))
-			C.jailparam_import(&params[2], cslastjidval)
-		}
-	}
-
-	C.jailparam_free(&params[0], 3)
-
-	return jls, err
-}
-
-func getJailResources(subject string, filter string) ([]Resource, error) {
+func getJailResources(src RacctSource, subject string, re *regexp.Regexp) ([]Resource, error) {
 	var resources []Resource
 
-	jls, err := getJails()
+	jls, err := src.Jails()
 	if err != nil {
 		return resources, err
 	}
-	re, err := regexp.Compile(filter)
-	if err != nil {
-		GLog.Fatal("rctlCollect %s do not compile", filter)
-	}
 
 	for _, jl := range jls {
-		if len(re.FindString(jl.name)) > 0 {
-			rule := fmt.Sprintf("%s:%s", subject, jl.name)
+		if len(re.FindString(jl.Name)) > 0 {
+			rule := fmt.Sprintf("%s:%s", subject, jl.Name)
 			GLog.Debug("Rule : " + rule)
-			r, err := getResourceUsage(rule)
-			if err != nil {
-				GLog.Error("Error while getting resource usage for rule : " + rule)
-				return resources, err
-			}
-			r.ResourceID = strconv.Itoa(jl.jid)
-			r.JailName = jl.name
+			r := Resource{rule: rule}
+			r.ResourceID = strconv.Itoa(jl.Jid)
+			r.JailName = jl.Name
+			r.JailParams = jl
+			r.JailParent = jailParentName(jls, jl)
 			resources = append(resources, r)
-			GLog.Debug("Added jail " + r.JailName + " with resources : " + r.RawResources)
 		}
 	}
 
 	return resources, err
 }
 
-// get currently enabled login classes from /etc/login.conf
-func getLoginClasses() ([]string, error) {
-	var lcs []string
-
-	data, err := ioutil.ReadFile("/etc/login.conf")
-	if err != nil {
-		return lcs, err
-	}
-	for _, line := range strings.Split(string(data), "\n") {
-		if len(line) > 0 && strings.HasPrefix(string(line), "#") == false && strings.HasPrefix(string(line), " ") == false {
-			s := strings.Split(string(line), ":")
-			if len(s) == 2 {
-				lc := strings.Split(s[0], "|")[0]
-				GLog.Debug("Appending loginclass " + lc)
-				lcs = append(lcs, lc)
-			}
-		}
-	}
-
-	return lcs, err
-}
-
-// TODO : Return ([]Resource, error), list login classes and support regex
-func getLoginClassResources(subject string, filter string) ([]Resource, error) {
+// Get Resources for login classes of login.conf matching re, with their limits set in login.conf
+func getLoginClassResources(src RacctSource, subject string, re *regexp.Regexp) ([]Resource, error) {
 	var resources []Resource
 
-	lcs, err := getLoginClasses()
+	lcs, err := src.LoginClasses()
 	if err != nil {
 		return resources, err
 	}
-	re, err := regexp.Compile(filter)
-	if err != nil {
-		GLog.Fatal("rctlCollect %s do not compile", filter)
-	}
 
 	for _, lc := range lcs {
-		if len(re.FindString(lc)) > 0 {
-			rule := fmt.Sprintf("%s:%s", subject, lc)
+		if len(re.FindString(lc.Name)) > 0 {
+			rule := fmt.Sprintf("%s:%s", subject, lc.Name)
 			GLog.Debug("Rule : " + rule)
-			r, err := getResourceUsage(rule)
+			r := Resource{rule: rule}
+			r.ResourceID = lc.Name
+			r.LoginClassName = lc.Name
+			r.LoginClassLimits, err = lc.ResourceLimits()
 			if err != nil {
-				GLog.Error("Error while getting resource usage for rule : " + rule)
-				return resources, err
+				GLog.Warn(err)
+				err = nil
 			}
-			//r.ResourceID = strconv.Itoa(jl.jid)
-			r.LoginClassName = lc
 			resources = append(resources, r)
-			GLog.Debug("Added loginclass " + r.LoginClassName + " with resources : " + r.RawResources)
 		}
 	}
 
@@ -626,16 +687,46 @@ func getLoginClassResources(subject string, filter string) ([]Resource, error) {
 
 // Bootstrap function to build Resource objects matching given filter
 // Should be the first function called, init GLog
-func NewResourceManager(resrcesFilter []string, log *logrus.Logger) (ResourceMgr, error) {
-	var resmgr ResourceMgr
+// Filters are compiled once, an error listing every invalid filter is returned before anything is collected.
+// Nothing is collected until Refresh or Start is called, so options can be set first.
+func NewResourceManager(resrcesFilter []string, source RacctSource, log *logrus.Logger) (*ResourceMgr, error) {
+	resmgr := &ResourceMgr{}
+
+	filters, err := compileFilters(resrcesFilter)
+	if err != nil {
+		return nil, err
+	}
 
 	// "log" var exists at global scope, but the value of the local variable inside a function takes preference
 	// FIXME
-	GLog = log
+	// GLog is read by refreshes running in background, only the first manager sets it
+	glogOnce.Do(func() { GLog = log })
 	resmgr.log = log
-	resmgr.resrcesfilter = resrcesFilter
-
-	resmgr.Refresh()
+	resmgr.resrcesfilter = filters
+	resmgr.source = source
+	resmgr.Workers = DEFAULT_WORKERS
+	resmgr.Limits = true
+	resmgr.Users = UserSelection{Source: USER_SOURCE_UTMPX, UidMax: -1}
 
 	return resmgr, nil
 }
+
+// Reconfigure : Replaces the filters, and calls configure to set other fields of the manager.
+// It waits for the running refresh, so a refresh sees either the previous configuration or the new one, never a mix of both.
+// When a filter is invalid, the configuration is not changed.
+func (r *ResourceMgr) Reconfigure(resrcesFilter []string, configure func(*ResourceMgr)) error {
+	filters, err := compileFilters(resrcesFilter)
+	if err != nil {
+		return err
+	}
+
+	r.cfgMu.Lock()
+	defer r.cfgMu.Unlock()
+
+	r.resrcesfilter = filters
+	if configure != nil {
+		configure(r)
+	}
+
+	return nil
+}
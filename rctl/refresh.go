@@ -0,0 +1,79 @@
+// Copyright 2020, johan@nosd.in
+//
+// Refresh resources usage in background, independently of scrapes
+package rctl
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// Resources are stale when not refreshed since this many intervals
+	STALE_INTERVALS = 3
+)
+
+// Start : Refreshes resources now, then every interval in a goroutine, until ctx is done.
+// Snapshot then returns the last refresh results without querying the kernel.
+func (r *ResourceMgr) Start(ctx context.Context, interval time.Duration) {
+	r.mu.Lock()
+	r.interval = interval
+	// A manager which never refreshed successfully is stale STALE_INTERVALS after it started
+	if r.succeeded.IsZero() {
+		r.succeeded = time.Now()
+	}
+	r.mu.Unlock()
+
+	// Snapshot is ready when Start returns
+	r.Refresh()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				r.mu.Lock()
+				r.interval = 0
+				r.mu.Unlock()
+				return
+			case <-ticker.C:
+				start := time.Now()
+				// Errors are logged by Refresh, and kept in the snapshot for scrapes
+				r.Refresh()
+				if elapsed := time.Since(start); elapsed > interval {
+					r.log.Warnf("Refresh took %v, longer than refresh interval %v", elapsed, interval)
+				}
+			}
+		}
+	}()
+}
+
+// RefreshInterval : Returns the background refresh interval, 0 if resources are only refreshed by Refresh calls
+func (r *ResourceMgr) RefreshInterval() time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.interval
+}
+
+// Stale : Returns true when no background refresh succeeded for STALE_INTERVALS intervals, either because
+// refreshes did not complete or because every filter failed
+func (r *ResourceMgr) Stale() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.interval == 0 {
+		return false
+	}
+	return time.Since(r.succeeded) > STALE_INTERVALS*r.interval
+}
+
+// LastSuccess : Returns the end of the last refresh where a filter succeeded, zero if there was none
+func (r *ResourceMgr) LastSuccess() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.succeeded
+}
@@ -0,0 +1,141 @@
+package rctl
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Returns a source listing n processes, with a syscall latency close to a loaded host
+func benchSource(n int) *FakeSource {
+	f := NewFakeSource()
+	for i := 0; i < n; i++ {
+		pid := 100 + i
+		f.ProcessList = append(f.ProcessList, Process{Pid: pid, Name: "worker", CmdLine: "worker -n " + strconv.Itoa(i)})
+		f.Usage["process:"+strconv.Itoa(pid)] = "cputime=1,memoryuse=1024"
+	}
+	f.Delay = 50 * time.Microsecond
+	return f
+}
+
+func BenchmarkRefresh(b *testing.B) {
+	const items = 200
+
+	for _, workers := range []int{1, DEFAULT_WORKERS, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			rm, err := NewResourceManager([]string{"process:^worker"}, benchSource(items), logrus.New())
+			if err != nil {
+				b.Fatal(err)
+			}
+			rm.Workers = workers
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := rm.Refresh(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			// Results are in listing order, whatever the number of workers
+			snap := rm.Snapshot()
+			if len(snap.Resources) != items || snap.Resources[10].ResourceID != "110" {
+				b.Fatalf("got %d resources, not in listing order", len(snap.Resources))
+			}
+		})
+	}
+}
+
+func TestNewResourceManagerDoesNotRefresh(t *testing.T) {
+	rm, err := NewResourceManager([]string{"process:^worker"}, benchSource(3), logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap := rm.Snapshot(); snap != nil {
+		t.Fatalf("got a snapshot of %d resources before any refresh", len(snap.Resources))
+	}
+
+	// Options set after the manager is created apply to the first refresh
+	rm.Limits = false
+	snap, err := rm.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Resources) != 3 || rm.Snapshot() != snap {
+		t.Errorf("got %d resources, want 3", len(snap.Resources))
+	}
+}
+
+// Returns true if cond becomes true within a second
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStart(t *testing.T) {
+	const interval = 10 * time.Millisecond
+
+	rm, err := NewResourceManager([]string{"process:^worker"}, benchSource(3), logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rm.Start(ctx, interval)
+
+	first := rm.Snapshot()
+	if first == nil || len(first.Resources) != 3 {
+		t.Fatalf("got snapshot %v when Start returned, want 3 resources", first)
+	}
+	if rm.RefreshInterval() != interval {
+		t.Errorf("got interval %v, want %v", rm.RefreshInterval(), interval)
+	}
+	if !eventually(func() bool { return rm.Snapshot() != first }) {
+		t.Error("snapshot was not refreshed in background")
+	}
+	if rm.Stale() || rm.LastSuccess().IsZero() {
+		t.Errorf("got stale %v, last success %v, want refreshed", rm.Stale(), rm.LastSuccess())
+	}
+
+	cancel()
+	if !eventually(func() bool { return rm.RefreshInterval() == 0 }) {
+		t.Error("background refresh did not stop")
+	}
+	if rm.Stale() {
+		t.Error("got stale without background refresh")
+	}
+}
+
+func TestStaleWhenAllFiltersFail(t *testing.T) {
+	const interval = 5 * time.Millisecond
+
+	f := NewFakeSource()
+	f.JailList = []Jail{{Name: "www", Jid: 1}}
+	f.Errors["jail:www"] = syscall.EPERM
+	rm, err := NewResourceManager([]string{"jail:.*"}, f, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rm.Start(ctx, interval)
+
+	// Refreshes complete, but none succeeds
+	if snap := rm.Snapshot(); snap == nil || !snap.AllFailed() {
+		t.Fatalf("got snapshot %v, want every filter failed", snap)
+	}
+	if !eventually(rm.Stale) {
+		t.Errorf("not stale after %d intervals without success", STALE_INTERVALS)
+	}
+	if !rm.LastSuccess().Before(rm.Snapshot().Time) {
+		t.Errorf("got last success %v, want before last refresh %v", rm.LastSuccess(), rm.Snapshot().Time)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020, johan@nosd.in
+//
+// Resources known by rctl(8)
+package rctl
+
+// ResourceName : Name of a resource as used by rctl(8), e.g. "memoryuse"
+type ResourceName string
+
+// ResourceKind : How a resource usage evolves
+type ResourceKind int
+
+const (
+	KIND_CURRENT    ResourceKind = iota // Current usage, goes up and down
+	KIND_CUMULATIVE                     // Accumulated since subject creation, only goes up
+	KIND_RATE                           // Decaying average over the last seconds
+)
+
+// ResourceInfo : What is known about a resource, see rctl(8) and racct_types in sys/kern/kern_racct.c
+type ResourceInfo struct {
+	Name        ResourceName
+	Unit        string // "seconds", "bytes", "percent", "bytes_per_second", "operations_per_second", empty for counts
+	Kind        ResourceKind
+	Description string
+	Deniable    bool // "deny" action is enforced
+	Decaying    bool // Rate resource, "throttle" action is supported
+}
+
+// KnownResources : Resources supported by rctl(8)
+var KnownResources = []ResourceInfo{
+	{Name: "cputime", Unit: "seconds", Kind: KIND_CUMULATIVE, Description: "CPU time"},
+	{Name: "datasize", Unit: "bytes", Description: "data size", Deniable: true},
+	{Name: "stacksize", Unit: "bytes", Description: "stack size", Deniable: true},
+	{Name: "coredumpsize", Unit: "bytes", Description: "core dump size", Deniable: true},
+	// memoryuse and pcpu are not deniable in the racct sense, but the kernel enforces deny rules on them
+	{Name: "memoryuse", Unit: "bytes", Description: "resident set size", Deniable: true},
+	{Name: "memorylocked", Unit: "bytes", Description: "locked memory", Deniable: true},
+	{Name: "maxproc", Description: "number of processes", Deniable: true},
+	{Name: "openfiles", Description: "file descriptor table size", Deniable: true},
+	{Name: "vmemoryuse", Unit: "bytes", Description: "address space limit", Deniable: true},
+	{Name: "pseudoterminals", Description: "number of PTYs", Deniable: true},
+	{Name: "swapuse", Unit: "bytes", Description: "swap space that may be reserved or used", Deniable: true},
+	{Name: "nthr", Description: "number of threads", Deniable: true},
+	{Name: "msgqqueued", Description: "number of queued SysV messages", Deniable: true},
+	{Name: "msgqsize", Unit: "bytes", Description: "SysV message queue size", Deniable: true},
+	{Name: "nmsgq", Description: "number of SysV message queues", Deniable: true},
+	{Name: "nsem", Description: "number of SysV semaphores", Deniable: true},
+	{Name: "nsemop", Description: "number of SysV semaphores modified in a single semop(2) call", Deniable: true},
+	{Name: "nshm", Description: "number of SysV shared memory segments", Deniable: true},
+	{Name: "shmsize", Unit: "bytes", Description: "SysV shared memory size", Deniable: true},
+	{Name: "wallclock", Unit: "seconds", Kind: KIND_CUMULATIVE, Description: "wallclock time"},
+	{Name: "pcpu", Unit: "percent", Kind: KIND_RATE, Description: "%CPU, in percents of a single CPU core", Deniable: true, Decaying: true},
+	{Name: "readbps", Unit: "bytes_per_second", Kind: KIND_RATE, Description: "filesystem reads", Decaying: true},
+	{Name: "writebps", Unit: "bytes_per_second", Kind: KIND_RATE, Description: "filesystem writes", Decaying: true},
+	{Name: "readiops", Unit: "operations_per_second", Kind: KIND_RATE, Description: "filesystem reads operations", Decaying: true},
+	{Name: "writeiops", Unit: "operations_per_second", Kind: KIND_RATE, Description: "filesystem writes operations", Decaying: true},
+}
+
+// LookupResource : Returns informations about a resource, false if rctl does not know it
+func LookupResource(name ResourceName) (ResourceInfo, bool) {
+	for _, ri := range KnownResources {
+		if ri.Name == name {
+			return ri, true
+		}
+	}
+	return ResourceInfo{}, false
+}
@@ -0,0 +1,137 @@
+// Copyright 2020, johan@nosd.in
+//
+// rctl rules, as described in rctl(8)
+package rctl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rule : A rctl rule, with syntax "subject:subject-id:resource:action=amount/per"
+type Rule struct {
+	Subject   string // process, user, loginclass or jail
+	SubjectID string // PID, user name or UID, login class name or jail name
+	Resource  string // Resource name, e.g. "memoryuse"
+	Action    string // Action taken when limit is reached : deny, log, devctl, throttle, sig*
+	Amount    int64  // Limit value
+	Per       string // Subject the limit is accounted for, empty means Subject
+}
+
+// Multipliers of amount suffixes, as accepted by expand_number(3)
+var amountSuffixes = map[byte]int64{
+	'b': 1,
+	'k': 1 << 10,
+	'm': 1 << 20,
+	'g': 1 << 30,
+	't': 1 << 40,
+	'p': 1 << 50,
+	'e': 1 << 60,
+}
+
+// ParseRule : Parses a rule such as "jail:www:memoryuse:deny=512m" or "user:1001:maxproc:deny=100/process".
+// Amount can use a k, m, g, t, p or e suffix.
+func ParseRule(rule string) (Rule, error) {
+	var r Rule
+
+	rule = strings.TrimSpace(rule)
+
+	fields := strings.Split(rule, ":")
+	if len(fields) != 4 {
+		return r, fmt.Errorf("invalid rule %q : expected subject:subject-id:resource:action=amount[/per]", rule)
+	}
+	r.Subject, r.SubjectID, r.Resource = fields[0], fields[1], fields[2]
+
+	if !isSupportedSubject(r.Subject) {
+		return r, fmt.Errorf("invalid rule %q : unknown subject %q", rule, r.Subject)
+	}
+	if len(r.SubjectID) == 0 {
+		return r, fmt.Errorf("invalid rule %q : missing subject-id", rule)
+	}
+	if len(r.Resource) == 0 {
+		return r, fmt.Errorf("invalid rule %q : missing resource", rule)
+	}
+
+	action := strings.SplitN(fields[3], "=", 2)
+	if len(action) != 2 {
+		return r, fmt.Errorf("invalid rule %q : missing amount", rule)
+	}
+	r.Action = action[0]
+	if len(r.Action) == 0 {
+		return r, fmt.Errorf("invalid rule %q : missing action", rule)
+	}
+
+	amount := action[1]
+	if i := strings.Index(amount, "/"); i >= 0 {
+		amount, r.Per = amount[:i], amount[i+1:]
+		if !isSupportedSubject(r.Per) {
+			return r, fmt.Errorf("invalid rule %q : unknown per subject %q", rule, r.Per)
+		}
+	}
+
+	v, err := ParseAmount(amount)
+	if err != nil {
+		return r, fmt.Errorf("invalid rule %q : %w", rule, err)
+	}
+	r.Amount = v
+
+	return r, nil
+}
+
+// ParseAmount : Parses a rule amount, with an optional k, m, g, t, p or e suffix
+func ParseAmount(amount string) (int64, error) {
+	mult := int64(1)
+
+	if len(amount) == 0 {
+		return 0, fmt.Errorf("empty amount")
+	}
+	last := amount[len(amount)-1]
+	if last >= 'A' && last <= 'Z' {
+		last += 'a' - 'A'
+	}
+	if m, ok := amountSuffixes[last]; ok {
+		mult = m
+		amount = amount[:len(amount)-1]
+	}
+
+	// Only digits are allowed, strconv would accept a sign
+	if len(amount) == 0 || strings.TrimLeft(amount, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	v, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q : %w", amount, err)
+	}
+	if v > (1<<63-1)/mult {
+		return 0, fmt.Errorf("amount %q overflows", amount)
+	}
+
+	return v * mult, nil
+}
+
+// PerSubject : Returns the subject the rule is accounted for
+func (r Rule) PerSubject() string {
+	if len(r.Per) > 0 {
+		return r.Per
+	}
+	return r.Subject
+}
+
+// String : Formats the rule with rctl(8) syntax, amount is not suffixed
+func (r Rule) String() string {
+	s := fmt.Sprintf("%s:%s:%s:%s=%d", r.Subject, r.SubjectID, r.Resource, r.Action, r.Amount)
+	if len(r.Per) > 0 {
+		s = s + "/" + r.Per
+	}
+	return s
+}
+
+func isSupportedSubject(subject string) bool {
+	for _, v := range SUPPORTED_SUBJECTS {
+		if v == subject {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package rctl
+
+import (
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		rule string
+		want Rule
+	}{
+		{"jail:www:memoryuse:deny=512", Rule{"jail", "www", "memoryuse", "deny", 512, ""}},
+		{"jail:www:memoryuse:deny=512b", Rule{"jail", "www", "memoryuse", "deny", 512, ""}},
+		{"jail:www:memoryuse:deny=512k", Rule{"jail", "www", "memoryuse", "deny", 512 << 10, ""}},
+		{"jail:www:memoryuse:deny=512m", Rule{"jail", "www", "memoryuse", "deny", 512 << 20, ""}},
+		{"jail:www:memoryuse:deny=512g", Rule{"jail", "www", "memoryuse", "deny", 512 << 30, ""}},
+		{"jail:www:memoryuse:deny=512t", Rule{"jail", "www", "memoryuse", "deny", 512 << 40, ""}},
+		{"jail:www:memoryuse:deny=512p", Rule{"jail", "www", "memoryuse", "deny", 512 << 50, ""}},
+		{"jail:www:memoryuse:deny=7e", Rule{"jail", "www", "memoryuse", "deny", 7 << 60, ""}},
+		{"jail:www:memoryuse:deny=1K", Rule{"jail", "www", "memoryuse", "deny", 1 << 10, ""}},
+		{"jail:www:memoryuse:deny=1M", Rule{"jail", "www", "memoryuse", "deny", 1 << 20, ""}},
+		{"jail:www:memoryuse:deny=0", Rule{"jail", "www", "memoryuse", "deny", 0, ""}},
+		{"user:1001:maxproc:deny=100/process", Rule{"user", "1001", "maxproc", "deny", 100, "process"}},
+		{"loginclass:daemon:openfiles:log=1k/user", Rule{"loginclass", "daemon", "openfiles", "log", 1024, "user"}},
+		{"process:12:pcpu:sigterm=50", Rule{"process", "12", "pcpu", "sigterm", 50, ""}},
+		{"jail:www:writebps:throttle=1m/jail", Rule{"jail", "www", "writebps", "throttle", 1 << 20, "jail"}},
+		{"  jail:www:nthr:devctl=8  ", Rule{"jail", "www", "nthr", "devctl", 8, ""}},
+		{"jail:www:memoryuse:deny=9223372036854775807", Rule{"jail", "www", "memoryuse", "deny", 1<<63 - 1, ""}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRule(tt.rule)
+		if err != nil {
+			t.Errorf("ParseRule(%q) : unexpected error %v", tt.rule, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRule(%q) = %+v, want %+v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"jail:www",
+		"jail:www:memoryuse",
+		"jail:www:memoryuse:deny=1:x",
+		"foo:www:memoryuse:deny=1",
+		"jail::memoryuse:deny=1",
+		"jail:www::deny=1",
+		"jail:www:memoryuse:deny",
+		"jail:www:memoryuse:=1",
+		"jail:www:memoryuse:deny=",
+		"jail:www:memoryuse:deny=m",
+		"jail:www:memoryuse:deny=-1",
+		"jail:www:memoryuse:deny=+1",
+		"jail:www:memoryuse:deny=1.5",
+		"jail:www:memoryuse:deny=1x",
+		"jail:www:memoryuse:deny=1/",
+		"jail:www:memoryuse:deny=1/foo",
+		"jail:www:memoryuse:deny=/process",
+		"jail:www:memoryuse:deny=9223372036854775808",
+		"jail:www:memoryuse:deny=8e",
+		"jail:www:memoryuse:deny=8388608t",
+	}
+
+	for _, rule := range tests {
+		if r, err := ParseRule(rule); err == nil {
+			t.Errorf("ParseRule(%q) = %+v, want an error", rule, r)
+		}
+	}
+}
+
+func TestRuleString(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		want string
+	}{
+		{Rule{"jail", "www", "memoryuse", "deny", 512 << 20, ""}, "jail:www:memoryuse:deny=536870912"},
+		{Rule{"user", "1001", "maxproc", "deny", 100, "process"}, "user:1001:maxproc:deny=100/process"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestPerSubject(t *testing.T) {
+	if got := (Rule{Subject: "jail", Per: "process"}).PerSubject(); got != "process" {
+		t.Errorf("PerSubject() = %q, want process", got)
+	}
+	if got := (Rule{Subject: "jail"}).PerSubject(); got != "jail" {
+		t.Errorf("PerSubject() = %q, want jail", got)
+	}
+}
+
+func FuzzParseRule(f *testing.F) {
+	f.Add("jail:www:memoryuse:deny=512m")
+	f.Add("user:1001:maxproc:deny=100/process")
+	f.Add("loginclass:daemon:openfiles:log=1K/user")
+	f.Add("process:12:pcpu:sigterm=50")
+	f.Add("jail:www:memoryuse:deny=7e")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		r, err := ParseRule(s)
+		if err != nil {
+			return
+		}
+		got, err := ParseRule(r.String())
+		if err != nil {
+			t.Fatalf("ParseRule(%q) of %q : %v", r.String(), s, err)
+		}
+		if got != r {
+			t.Fatalf("ParseRule(%q) = %+v, want %+v", r.String(), got, r)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+// Copyright 2020, johan@nosd.in
+//
+// Check rctl.conf files
+package rctl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Signals accepted as action, see rctl(8) and signal(3)
+var ruleSignals = []string{"sighup", "sigint", "sigquit", "sigill", "sigtrap", "sigabrt", "sigemt", "sigfpe",
+	"sigkill", "sigbus", "sigsegv", "sigsys", "sigpipe", "sigalrm", "sigterm", "sigurg", "sigstop", "sigtstp",
+	"sigcont", "sigchld", "sigttin", "sigttou", "sigio", "sigxcpu", "sigxfsz", "sigvtalrm", "sigprof",
+	"sigwinch", "siginfo", "sigusr1", "sigusr2", "sigthr", "siglibrt"}
+
+// RuleError : A problem found in a rules file
+type RuleError struct {
+	Line int    // Line number, starting at 1
+	Rule string // Rule as written in the file
+	Msg  string
+}
+
+func (e RuleError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Validate : Checks the rule would be accepted by the kernel
+func (r Rule) Validate() error {
+	ri, ok := LookupResource(ResourceName(r.Resource))
+	if !ok {
+		return fmt.Errorf("unknown resource %q", r.Resource)
+	}
+
+	switch {
+	case r.Action == "deny":
+		if !ri.Deniable {
+			return fmt.Errorf("action deny is not supported for resource %s", r.Resource)
+		}
+	case r.Action == "throttle":
+		if !ri.Decaying {
+			return fmt.Errorf("action throttle is not supported for resource %s", r.Resource)
+		}
+		if r.Amount == 0 {
+			return fmt.Errorf("action throttle needs a non zero amount")
+		}
+	case r.Action == "log", r.Action == "devctl":
+	case strings.HasPrefix(r.Action, "sig"):
+		if !isRuleSignal(r.Action) {
+			return fmt.Errorf("unknown signal %q", r.Action)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	return nil
+}
+
+func isRuleSignal(action string) bool {
+	for _, s := range ruleSignals {
+		if s == action {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRules : Parses rules in rctl.conf format, one rule per line, "#" starting a comment.
+// Returns valid rules and every problem found : syntax errors, unknown resources,
+// unsupported actions, duplicate and conflicting rules.
+func CheckRules(in io.Reader) ([]Rule, []RuleError, error) {
+	var rules []Rule
+	var problems []RuleError
+	// First occurrence of each rule, by rule without amount
+	seen := make(map[string]RuleError)
+	amounts := make(map[string]int64)
+
+	scanner := bufio.NewScanner(in)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		// Like /etc/rc.d/rctl, only the first word is a rule
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		text := fields[0]
+
+		r, err := ParseRule(text)
+		if err != nil {
+			problems = append(problems, RuleError{Line: lineno, Rule: text, Msg: err.Error()})
+			continue
+		}
+		if err := r.Validate(); err != nil {
+			problems = append(problems, RuleError{Line: lineno, Rule: text, Msg: fmt.Sprintf("invalid rule %q : %s", text, err)})
+			continue
+		}
+
+		// The kernel replaces a deny rule with same subject, resource and per, whatever its amount.
+		// Other actions fire at each threshold, so only identical rules are duplicates.
+		key := fmt.Sprintf("%s:%s:%s:%s/%s", r.Subject, r.SubjectID, r.Resource, r.Action, r.PerSubject())
+		if r.Action != "deny" {
+			key += fmt.Sprintf("=%d", r.Amount)
+		}
+		if first, ok := seen[key]; ok {
+			if amounts[key] == r.Amount {
+				problems = append(problems, RuleError{Line: lineno, Rule: text,
+					Msg: fmt.Sprintf("rule %q duplicates rule %q at line %d", text, first.Rule, first.Line)})
+			} else {
+				problems = append(problems, RuleError{Line: lineno, Rule: text,
+					Msg: fmt.Sprintf("rule %q conflicts with rule %q at line %d, and replaces it", text, first.Rule, first.Line)})
+			}
+			continue
+		}
+		seen[key] = RuleError{Line: lineno, Rule: text}
+		amounts[key] = r.Amount
+		rules = append(rules, r)
+	}
+
+	return rules, problems, scanner.Err()
+}
@@ -0,0 +1,105 @@
+package rctl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		rule string
+		err  string // Expected error substring, empty for a valid rule
+	}{
+		{"user:1001:memoryuse:deny=1g", ""},
+		{"jail:www:pcpu:deny=50", ""},
+		{"jail:www:pcpu:throttle=50", ""},
+		{"jail:www:writebps:throttle=1m", ""},
+		{"jail:www:cputime:sigxcpu=3600", ""},
+		{"jail:www:cputime:log=3600", ""},
+		{"jail:www:maxproc:devctl=100", ""},
+		{"jail:www:cputime:deny=3600", "action deny is not supported for resource cputime"},
+		{"jail:www:writebps:deny=1m", "action deny is not supported for resource writebps"},
+		{"jail:www:maxproc:throttle=100", "action throttle is not supported for resource maxproc"},
+		{"jail:www:pcpu:throttle=0", "action throttle needs a non zero amount"},
+		{"jail:www:nosuch:deny=1", "unknown resource \"nosuch\""},
+		{"jail:www:maxproc:sigfoo=1", "unknown signal \"sigfoo\""},
+		{"jail:www:maxproc:reboot=1", "unknown action \"reboot\""},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseRule(tt.rule)
+		if err != nil {
+			t.Fatalf("ParseRule(%q) : %v", tt.rule, err)
+		}
+		err = r.Validate()
+		switch {
+		case len(tt.err) == 0 && err != nil:
+			t.Errorf("%s : unexpected error %v", tt.rule, err)
+		case len(tt.err) > 0 && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s : got error %v, want %q", tt.rule, err, tt.err)
+		}
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	conf := `# rctl.conf
+user:1001:memoryuse:deny=1g
+jail:www:maxproc:deny=100 # web workers
+
+jail:www:nosuch:deny=1
+jail:www:maxproc:throttle=10
+jail:www:cputime:deny=3600
+user:1001:memoryuse:deny=1g
+user:1001:memoryuse:deny=2g
+user:1001:memoryuse:deny=2g/process
+user:1001:memoryuse:devctl=1g
+user:1001:memoryuse:devctl=2g
+user:1001:memoryuse:devctl=2g
+jail:www:pcpu:deny=50 trailing words are ignored
+jail:www
+`
+
+	rules, problems, err := CheckRules(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var texts []string
+	for _, r := range rules {
+		texts = append(texts, r.String())
+	}
+	wantRules := []string{
+		"user:1001:memoryuse:deny=1073741824",
+		"jail:www:maxproc:deny=100",
+		"user:1001:memoryuse:deny=2147483648/process",
+		"user:1001:memoryuse:devctl=1073741824",
+		"user:1001:memoryuse:devctl=2147483648",
+		"jail:www:pcpu:deny=50",
+	}
+	if !reflect.DeepEqual(texts, wantRules) {
+		t.Errorf("got rules %q, want %q", texts, wantRules)
+	}
+
+	wantProblems := []struct {
+		line int
+		msg  string
+	}{
+		{5, "unknown resource"},
+		{6, "action throttle is not supported for resource maxproc"},
+		{7, "action deny is not supported for resource cputime"},
+		{8, `duplicates rule "user:1001:memoryuse:deny=1g" at line 2`},
+		{9, `conflicts with rule "user:1001:memoryuse:deny=1g" at line 2`},
+		// Thresholds of other actions coexist, only identical rules are reported
+		{13, `duplicates rule "user:1001:memoryuse:devctl=2g" at line 12`},
+		{15, "jail:www"},
+	}
+	if len(problems) != len(wantProblems) {
+		t.Fatalf("got problems %v, want %d", problems, len(wantProblems))
+	}
+	for i, want := range wantProblems {
+		if problems[i].Line != want.line || !strings.Contains(problems[i].Msg, want.msg) {
+			t.Errorf("got problem %v, want line %d: %s", problems[i], want.line, want.msg)
+		}
+	}
+}
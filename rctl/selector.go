@@ -0,0 +1,261 @@
+// Copyright 2020, johan@nosd.in
+//
+// Process selectors, matching processes on their attributes instead of their command line
+package rctl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Attributes a selector can match
+var selectorKeys = []string{"pid", "uid", "user", "jail", "jid", "ppid", "exe", "pidfile", "cmdline"}
+
+// Selector : Process selector such as "jail=web01,exe=nginx;user=www".
+// Terms separated by ',' must all match, groups of terms separated by ';' are alternatives.
+// A ',' or ';' only separates terms when followed by a key, so values like "cmdline=~a{1,3}" are kept whole.
+type Selector [][]selectorTerm
+
+// One attribute matcher, "key=value" or "key=~regexp"
+type selectorTerm struct {
+	key   string
+	value string
+	re    *regexp.Regexp
+	num   int // value of pid, uid, jid and ppid terms
+}
+
+// Names of users and jails, and PIDs of pidfiles, read once per refresh
+type selectorContext struct {
+	users    map[int]string
+	jails    map[int]string
+	pidfiles map[string]int
+}
+
+// IsSelector : Returns true if a process filter is a selector rather than a command line regexp
+func IsSelector(filter string) bool {
+	for _, key := range selectorKeys {
+		if strings.HasPrefix(filter, key+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSelector : Parses a selector. pid, uid, jid and ppid take a number, pidfile a path,
+// user, jail, exe and cmdline a value or a regexp prefixed by '~'.
+func ParseSelector(selector string) (Selector, error) {
+	var sel Selector
+
+	for _, group := range splitSelector(selector) {
+		var terms []selectorTerm
+		for _, t := range group {
+			term, err := parseSelectorTerm(t)
+			if err != nil {
+				return sel, fmt.Errorf("invalid selector %q : %w", selector, err)
+			}
+			terms = append(terms, term)
+		}
+		sel = append(sel, terms)
+	}
+
+	return sel, nil
+}
+
+// Splits a selector into groups of terms, on ',' and ';' followed by "key="
+func splitSelector(selector string) [][]string {
+	var groups [][]string
+	var terms []string
+
+	start := 0
+	for i := 0; i < len(selector); i++ {
+		if (selector[i] != ',' && selector[i] != ';') || !IsSelector(strings.TrimLeft(selector[i+1:], " \t")) {
+			continue
+		}
+		terms = append(terms, selector[start:i])
+		start = i + 1
+		if selector[i] == ';' {
+			groups = append(groups, terms)
+			terms = nil
+		}
+	}
+	terms = append(terms, selector[start:])
+
+	return append(groups, terms)
+}
+
+func parseSelectorTerm(t string) (selectorTerm, error) {
+	var term selectorTerm
+
+	s := strings.SplitN(strings.TrimSpace(t), "=", 2)
+	if len(s) != 2 || len(s[1]) == 0 {
+		return term, fmt.Errorf("expected key=value, got %q", t)
+	}
+	term.key, term.value = s[0], s[1]
+
+	switch term.key {
+	case "pid", "uid", "jid", "ppid":
+		n, err := strconv.Atoi(term.value)
+		if err != nil {
+			return term, fmt.Errorf("%s expects a number, got %q", term.key, term.value)
+		}
+		term.num = n
+	case "user", "jail", "exe", "cmdline":
+		if strings.HasPrefix(term.value, "~") {
+			re, err := regexp.Compile(term.value[1:])
+			if err != nil {
+				return term, err
+			}
+			term.re = re
+		}
+	case "pidfile":
+	default:
+		return term, fmt.Errorf("unknown key %q, expected one of %s", term.key, strings.Join(selectorKeys, ", "))
+	}
+
+	return term, nil
+}
+
+// Returns true if the selector uses key
+func (s Selector) uses(key string) bool {
+	for _, terms := range s {
+		for _, t := range terms {
+			if t.key == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns a context with names needed by the selector
+func (s Selector) newContext(src RacctSource) (*selectorContext, error) {
+	ctx := &selectorContext{pidfiles: make(map[string]int)}
+
+	if s.uses("user") {
+		accounts, err := src.Accounts()
+		if err != nil {
+			return ctx, err
+		}
+		// Processes of root are owned by root, not by toor
+		ctx.users = make(map[int]string)
+		for uid, usr := range accountsByUid(accounts) {
+			ctx.users[uid] = usr.Name
+		}
+	}
+	if s.uses("jail") {
+		jls, err := src.Jails()
+		if err != nil {
+			return ctx, err
+		}
+		ctx.jails = make(map[int]string)
+		for _, jl := range jls {
+			ctx.jails[jl.Jid] = jl.Name
+		}
+	}
+
+	return ctx, nil
+}
+
+// Returns true if the process matches all terms of one of the selector groups
+func (s Selector) match(p Process, ctx *selectorContext) bool {
+	for _, terms := range s {
+		matched := true
+		for _, t := range terms {
+			if !t.match(p, ctx) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (t selectorTerm) match(p Process, ctx *selectorContext) bool {
+	switch t.key {
+	case "pid":
+		return p.Pid == t.num
+	case "uid":
+		return p.Uid == t.num
+	case "jid":
+		return p.Jid == t.num
+	case "ppid":
+		return p.PPid == t.num
+	case "user":
+		name, ok := ctx.users[p.Uid]
+		if !ok {
+			name = strconv.Itoa(p.Uid)
+		}
+		return t.matchString(name)
+	case "jail":
+		// Processes running on the host are not in any jail
+		name, ok := ctx.jails[p.Jid]
+		return ok && t.matchString(name)
+	case "exe":
+		return t.matchString(p.Name)
+	case "cmdline":
+		return t.matchString(p.CmdLine)
+	case "pidfile":
+		pid := ctx.pidfilePid(t.value)
+		return pid > 0 && pid == p.Pid
+	}
+	return false
+}
+
+func (t selectorTerm) matchString(value string) bool {
+	if t.re != nil {
+		return t.re.MatchString(value)
+	}
+	return value == t.value
+}
+
+// Returns the PID written in a pidfile, 0 if it can not be read
+func (ctx *selectorContext) pidfilePid(file string) int {
+	if pid, ok := ctx.pidfiles[file]; ok {
+		return pid
+	}
+
+	pid := 0
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		pid, err = strconv.Atoi(strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0]))
+	}
+	if err != nil {
+		GLog.Debugf("Can not read pid from %s : %v", file, err)
+	}
+	ctx.pidfiles[file] = pid
+
+	return pid
+}
+
+// SplitFilters : Splits a comma separated list of filters. A comma only starts a new filter when followed by
+// a subject, so regexps like "a{1,3}" and selectors like "process:jail=web01,exe=nginx" are kept whole.
+func SplitFilters(arg string) []string {
+	var filters []string
+
+	for _, s := range strings.Split(arg, ",") {
+		if len(filters) == 0 || startsWithSubject(s) {
+			filters = append(filters, s)
+			continue
+		}
+		filters[len(filters)-1] += "," + s
+	}
+
+	return filters
+}
+
+// Returns true if s starts with "subject:" or "!subject:"
+func startsWithSubject(s string) bool {
+	s = strings.TrimPrefix(s, "!")
+	for _, subject := range FILTER_SUBJECTS {
+		if strings.HasPrefix(s, subject+":") {
+			return true
+		}
+	}
+	return false
+}
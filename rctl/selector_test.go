@@ -0,0 +1,103 @@
+package rctl
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSplitSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     [][]string
+	}{
+		{"exe=nginx", [][]string{{"exe=nginx"}}},
+		{"jail=web01,exe=nginx;user=www", [][]string{{"jail=web01", "exe=nginx"}, {"user=www"}}},
+		{"jail=web01, exe=nginx; user=www", [][]string{{"jail=web01", " exe=nginx"}, {" user=www"}}},
+		// Separators not followed by a key are part of the value
+		{"cmdline=~a{1,3}", [][]string{{"cmdline=~a{1,3}"}}},
+		{"cmdline=~a{1,3},exe=sh", [][]string{{"cmdline=~a{1,3}", "exe=sh"}}},
+		{"cmdline=~x;y;exe=sh", [][]string{{"cmdline=~x;y"}, {"exe=sh"}}},
+		{"exe=a,,uid=1", [][]string{{"exe=a,", "uid=1"}}},
+	}
+
+	for _, tt := range tests {
+		if got := splitSelector(tt.selector); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitSelector(%q) = %q, want %q", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestSelector(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "postgres.pid")
+	if err := os.WriteFile(pidfile, []byte("7\n/var/db/postgres\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFakeSource()
+	f.JailList = []Jail{{Name: "web01", Jid: 2}}
+	f.AccountList = []User{{Name: "root", Uid: 0}, {Name: "toor", Uid: 0}, {Name: "www", Uid: 80}}
+	f.ProcessList = []Process{
+		{Pid: 1, Name: "nginx", Jid: 2, Uid: 80, CmdLine: "nginx: master process"},
+		{Pid: 2, Name: "nginx", Uid: 80, CmdLine: "nginx: worker process"},
+		{Pid: 3, Name: "haproxy", PPid: 1, CmdLine: "haproxy -f /usr/local/etc/haproxy.conf"},
+		{Pid: 4, Name: "sh", CmdLine: "aaa,b"},
+		{Pid: 7, Name: "postgres", Uid: 770, CmdLine: "postgres -D /var/db/postgres"},
+	}
+	for _, p := range f.ProcessList {
+		f.Usage["process:"+strconv.Itoa(p.Pid)] = "cputime=1"
+	}
+
+	tests := []struct {
+		selector string
+		want     []string
+	}{
+		{"jail=web01,exe=nginx", []string{"1"}},
+		{"exe=nginx;exe=haproxy", []string{"1", "2", "3"}},
+		{"user=www,jid=0", []string{"2"}},
+		{"ppid=1", []string{"3"}},
+		{"pidfile=" + pidfile, []string{"7"}},
+		{"pidfile=" + pidfile + ".missing", nil},
+		{"cmdline=~^nginx,jail=~web", []string{"1"}},
+		// Users without account are named by their UID
+		{"user=770", []string{"7"}},
+		// root and toor share UID 0, processes are owned by the first one
+		{"user=root", []string{"3", "4"}},
+		{"user=toor", nil},
+		{"uid=80,exe=nginx;uid=770", []string{"1", "2", "7"}},
+		{"cmdline=~^a{1,3},b$", []string{"4"}},
+		{"cmdline=~^a{1,3},exe=sh", []string{"4"}},
+	}
+
+	for _, tt := range tests {
+		rm, err := NewResourceManager([]string{"process:" + tt.selector}, f, logrus.New())
+		if err != nil {
+			t.Errorf("%s : unexpected error %v", tt.selector, err)
+			continue
+		}
+		snap, err := rm.Refresh()
+		if err != nil {
+			t.Errorf("%s : unexpected error %v", tt.selector, err)
+			continue
+		}
+		var got []string
+		for _, r := range snap.Resources {
+			got = append(got, r.ResourceID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s : got %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, selector := range []string{"uid=x", "exe=", "foo=b", "exe=a;uid=x", "cmdline=~(", "pid=1,"} {
+		if _, err := ParseSelector(selector); err == nil {
+			t.Errorf("ParseSelector(%q) : want an error", selector)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020, johan@nosd.in
+//
+// Backends used by ResourceMgr to enumerate subjects and query RACCT
+package rctl
+
+import "strconv"
+
+// RacctSource : Backend queried by ResourceMgr. The syscall backend talks to the FreeBSD kernel,
+// FakeSource serves in-memory fixtures so the package can be used where there is no RACCT.
+type RacctSource interface {
+	// GetRacct returns resources usage for filter ("jail:www", "process:1234:"...) as rctl_get_racct(2) does
+	GetRacct(filter string) (string, error)
+	// GetRules returns rules matching filter as rctl_get_rules(2) does
+	GetRules(filter string) (string, error)
+	// GetLimits returns rules applying to the process in filter as rctl_get_limits(2) does
+	GetLimits(filter string) (string, error)
+	// Processes returns running processes
+	Processes() ([]Process, error)
+	// Users returns users currently logged in, from utmpx
+	Users() ([]User, error)
+	// Accounts returns users from the password database
+	Accounts() ([]User, error)
+	// Jails returns running jails
+	Jails() ([]Jail, error)
+	// LoginClasses returns login classes, with their capabilities
+	LoginClasses() ([]LoginClass, error)
+}
+
+// Process : A running process as seen by the source
+type Process struct {
+	Pid     int
+	PPid    int
+	Name    string // Binary name
+	CmdLine string // Full command line with path and args
+	Uid     int    // Real UID, the one RACCT accounts usage to
+	Jid     int    // JID of the jail running the process, 0 on host
+}
+
+// User : A user account
+type User struct {
+	Name  string
+	Uid   int
+	Class string // Login class, only known from master.passwd, empty when unknown
+}
+
+// Jail : A running jail, with parameters as listed by jls(8)
+type Jail struct {
+	Name      string
+	Jid       int
+	Hostname  string // host.hostname
+	Path      string // Jail root directory
+	OSRelease string // osrelease reported to jailed processes
+	Parent    int    // JID of the parent jail, 0 for jails created on the host
+	IP4       string // Comma separated IPv4 addresses
+	IP6       string // Comma separated IPv6 addresses
+	VNet      string // "new" if the jail has its own network stack, else "inherit"
+}
+
+// Sets a Jail field from a libjail parameter exported as a string
+func setJailParam(jl *Jail, name string, value string) {
+	switch name {
+	case "name":
+		jl.Name = value
+	case "jid":
+		jl.Jid, _ = strconv.Atoi(value)
+	case "host.hostname":
+		jl.Hostname = value
+	case "path":
+		jl.Path = value
+	case "osrelease":
+		jl.OSRelease = value
+	case "parent":
+		jl.Parent, _ = strconv.Atoi(value)
+	case "ip4.addr":
+		jl.IP4 = value
+	case "ip6.addr":
+		jl.IP6 = value
+	case "vnet":
+		jl.VNet = value
+	}
+}
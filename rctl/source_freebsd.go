@@ -0,0 +1,256 @@
+// Copyright 2020, johan@nosd.in
+//go:build freebsd
+// +build freebsd
+
+// Use libjail.so to get/set jail params
+package rctl
+
+/*
+#cgo CFLAGS: -I /usr/lib
+#cgo LDFLAGS: -L. -ljail -lutil -lc
+#include <stdlib.h>
+#include <sys/param.h>
+#include <sys/user.h>
+#include <libutil.h>
+#include <jail.h>
+#include <utmpx.h>
+#include <pwd.h>
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	ps "github.com/yo000/go-ps"
+	"golang.org/x/sys/unix"
+)
+
+// SyscallSource : RacctSource querying the running FreeBSD kernel
+type SyscallSource struct{}
+
+// NewSyscallSource : Returns the RacctSource backed by rctl syscalls, libjail and utmpx
+func NewSyscallSource() RacctSource {
+	return &SyscallSource{}
+}
+
+// GetRacct : Calls rctl_get_racct(2)
+func (s *SyscallSource) GetRacct(filter string) (string, error) {
+	return rctlCall(SYS_RCTL_GET_RACCT, "rctl_get_racct", filter)
+}
+
+// GetRules : Calls rctl_get_rules(2)
+func (s *SyscallSource) GetRules(filter string) (string, error) {
+	return rctlCall(SYS_RCTL_GET_RULES, "rctl_get_rules", filter)
+}
+
+// GetLimits : Calls rctl_get_limits(2)
+func (s *SyscallSource) GetLimits(filter string) (string, error) {
+	return rctlCall(SYS_RCTL_GET_LIMITS, "rctl_get_limits", filter)
+}
+
+// Processes : Returns running processes
+func (s *SyscallSource) Processes() ([]Process, error) {
+	var procs []Process
+
+	processList, err := ps.Processes()
+	if err != nil {
+		return procs, err
+	}
+
+	// go-ps does not return credentials
+	creds, err := getProcsCreds()
+	if err != nil {
+		return procs, err
+	}
+
+	procs = make([]Process, 0, len(processList))
+	for _, p := range processList {
+		// Processes which exited between both lists are skipped
+		cred, ok := creds[p.Pid()]
+		if !ok {
+			continue
+		}
+		procs = append(procs, Process{Pid: p.Pid(), PPid: p.PPid(), Name: p.Executable(), CmdLine: p.CommandLine(),
+			Uid: cred.uid, Jid: cred.jid})
+	}
+
+	return procs, nil
+}
+
+// Users : Returns users currently logged in
+func (s *SyscallSource) Users() ([]User, error) {
+	return getUsers()
+}
+
+// Accounts : Returns users from /etc/master.passwd, which holds login classes,
+// or from /etc/passwd when not running as root
+func (s *SyscallSource) Accounts() ([]User, error) {
+	usrs, err := getUsersFromPasswd("/etc/master.passwd")
+	if errors.Is(err, os.ErrPermission) {
+		return getUsersFromPasswd("/etc/passwd")
+	}
+	return usrs, err
+}
+
+// Jails : Returns running jails
+func (s *SyscallSource) Jails() ([]Jail, error) {
+	return getJails()
+}
+
+// LoginClasses : Returns login classes from /etc/login.conf
+func (s *SyscallSource) LoginClasses() ([]LoginClass, error) {
+	return ReadLoginConf(LOGIN_CONF)
+}
+
+// Appel des syscalls sys_rctl_get_racct, sys_rctl_get_rules et sys_rctl_get_limits implémentés dans sys/kern/kern_rctl.c
+// Ils partagent la même signature (inbufp, inbuflen, outbufp, outbuflen), et retournent ERANGE si outbuf est trop petit
+// Le corps de fonction est copié de https://go.googlesource.com/go/+/refs/tags/go1.15.3/src/syscall/zsyscall_freebsd_amd64.go
+func rctlCall(trap uintptr, name string, rule string) (string, error) {
+	_rule, err := unix.BytePtrFromString(rule)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := callWithBuffer(name, rule, RCTL_MAX_OUTBUFLEN, func(_out []byte) error {
+		_, _, e1 := syscall.Syscall6(trap, uintptr(unsafe.Pointer(_rule)),
+			uintptr(len(rule)+1), uintptr(unsafe.Pointer(&_out[0])),
+			uintptr(len(_out)), 0, 0)
+		if e1 != 0 {
+			return e1
+		}
+		return nil
+	})
+	// Not logged here, callers know which errors are expected, like ESRCH for exited processes.
+	// ENOSYS (78) : "RACCT/RCTL present, but disabled; enable using kern.racct.enable=1 tunable"
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return result, fmt.Errorf("%s(%s) : %w", name, rule, err)
+	}
+
+	return result, err
+}
+
+type procCred struct {
+	uid int
+	jid int
+}
+
+// get real UID, the one RACCT accounts usage to, and JID of running processes by PID
+func getProcsCreds() (map[int]procCred, error) {
+	var cnt C.int
+
+	kp, err := C.kinfo_getallproc(&cnt)
+	if kp == nil {
+		return nil, fmt.Errorf("kinfo_getallproc: %w", err)
+	}
+	defer C.free(unsafe.Pointer(kp))
+
+	creds := make(map[int]procCred, int(cnt))
+	for _, k := range unsafe.Slice(kp, int(cnt)) {
+		creds[int(k.ki_pid)] = procCred{uid: int(k.ki_ruid), jid: int(k.ki_jid)}
+	}
+
+	return creds, nil
+}
+
+// get users from utx database
+func getUsers() ([]User, error) {
+	var utx *C.struct_utmpx
+	var pw *C.struct_passwd
+	var users []User
+
+	// Open active DB
+	C.setutxent()
+
+	for {
+		utx = C.getutxent()
+		if utx == nil {
+			break
+		}
+		if utx.ut_type != USER_PROCESS {
+			continue
+		}
+
+		if containsUser(users, C.GoString(&utx.ut_user[0])) == false {
+			pw = C.getpwnam(&utx.ut_user[0])
+			if pw == nil {
+				errr := fmt.Sprintf("Error caling getpwnam for %s\n", C.GoString(&utx.ut_user[0]))
+				return nil, errors.New(errr)
+			}
+			usr := User{Name: C.GoString(&utx.ut_user[0]), Uid: int(pw.pw_uid)}
+			users = append(users, usr)
+		}
+		//fmt.Printf("%s\n", C.GoString(&utx.ut_user[0]))
+	}
+
+	// Close utx.active DB
+	C.endutxent()
+
+	return users, nil
+}
+
+// Jail parameters fetched by getJails. "lastjid" is the key used to iterate on jails and must stay last.
+var jailParams = []string{"name", "jid", "host.hostname", "path", "osrelease", "parent", "ip4.addr", "ip6.addr", "vnet", "lastjid"}
+
+// We can not use jail_getv ou jail_setv because they are variadic C functions (would need a C wrapper)
+func getJails() ([]Jail, error) {
+	var jls []Jail
+	var err error
+
+	params := make([]C.struct_jailparam, len(jailParams))
+	var names []string
+
+	// initialize params struct with parameter names. Parameters the kernel does not know,
+	// like ip6.addr on a kernel without INET6, are skipped.
+	for _, name := range jailParams {
+		csname := C.CString(name)
+		ret := C.jailparam_init(&params[len(names)], csname)
+		C.free(unsafe.Pointer(csname))
+		if ret != 0 {
+			if name == "lastjid" || name == "name" || name == "jid" {
+				return jls, fmt.Errorf("jailparam_init %s: %s", name, C.GoString((*C.char)(unsafe.Pointer(&C.jail_errmsg))))
+			}
+			continue
+		}
+		names = append(names, name)
+	}
+	nparams := len(names)
+	defer C.jailparam_free(&params[0], C.uint(nparams))
+
+	// The key to retrieve jail. lastjid = 0 returns first jail and its jid as jailparam_get return value
+	lastjailid := 0
+	cslastjidval := C.CString(strconv.Itoa(lastjailid))
+	C.jailparam_import(&params[nparams-1], cslastjidval)
+	C.free(unsafe.Pointer(cslastjidval))
+
+	// loop on existing jails
+	for lastjailid >= 0 {
+		// get parameter values
+		lastjailid = int(C.jailparam_get(&params[0], C.uint(nparams), 0))
+		if lastjailid > 0 {
+			var jl Jail
+			for i, name := range names[:nparams-1] {
+				valtmp := C.jailparam_export(&params[i])
+				if valtmp == nil {
+					continue
+				}
+				setJailParam(&jl, name, C.GoString(valtmp))
+				// Memory mgmt : Non gere par Go
+				C.free(unsafe.Pointer(valtmp))
+			}
+			jls = append(jls, jl)
+			//GLog.Debug("Got jid " + strconv.Itoa(jl.Jid) + " with name " + jl.Name)
+
+			// Prepare next loop iteration
+			cslastjidval := C.CString(strconv.Itoa(lastjailid))
+			C.jailparam_import(&params[nparams-1], cslastjidval)
+			C.free(unsafe.Pointer(cslastjidval))
+		}
+	}
+
+	return jls, err
+}
@@ -0,0 +1,26 @@
+// Copyright 2020, johan@nosd.in
+//go:build !freebsd
+// +build !freebsd
+
+// RACCT is only available on FreeBSD
+package rctl
+
+import (
+	"syscall"
+)
+
+type unsupportedSource struct{}
+
+// NewSyscallSource : Returns a RacctSource failing with ENOSYS, as there is no rctl syscall on this platform
+func NewSyscallSource() RacctSource {
+	return unsupportedSource{}
+}
+
+func (s unsupportedSource) GetRacct(filter string) (string, error)  { return "", syscall.ENOSYS }
+func (s unsupportedSource) GetRules(filter string) (string, error)  { return "", syscall.ENOSYS }
+func (s unsupportedSource) GetLimits(filter string) (string, error) { return "", syscall.ENOSYS }
+func (s unsupportedSource) Processes() ([]Process, error)           { return nil, syscall.ENOSYS }
+func (s unsupportedSource) Users() ([]User, error)                  { return nil, syscall.ENOSYS }
+func (s unsupportedSource) Accounts() ([]User, error)               { return nil, syscall.ENOSYS }
+func (s unsupportedSource) Jails() ([]Jail, error)                  { return nil, syscall.ENOSYS }
+func (s unsupportedSource) LoginClasses() ([]LoginClass, error)     { return nil, syscall.ENOSYS }
@@ -0,0 +1,153 @@
+// Copyright 2020, johan@nosd.in
+//
+// Enumerate users whose resources are collected
+package rctl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	USER_SOURCE_UTMPX   = "utmpx"   // Users with a session, daemon accounts are missed
+	USER_SOURCE_PASSWD  = "passwd"  // All accounts of the password database
+	USER_SOURCE_PROCESS = "process" // Owners of running processes
+	USER_SOURCE_ALL     = "all"     // Union of all sources
+)
+
+// Supported user sources
+var USER_SOURCES = []string{USER_SOURCE_UTMPX, USER_SOURCE_PASSWD, USER_SOURCE_PROCESS, USER_SOURCE_ALL}
+
+// UserSelection : Where users are enumerated from, and UID range of collected users
+type UserSelection struct {
+	Source string // One of USER_SOURCES
+	UidMin int    // Users with a lower UID are not collected, e.g. 1000 to skip system accounts
+	UidMax int    // Users with a greater UID are not collected, no upper bound if negative
+}
+
+// Returns selected users, sorted by UID
+func listUsers(src RacctSource, sel UserSelection) ([]User, error) {
+	byUid := make(map[int]User)
+
+	if !isUserSource(sel.Source) {
+		return nil, fmt.Errorf("unknown user source %q", sel.Source)
+	}
+
+	// Process owners are named from the password database too, and it gives users login class
+	accounts, err := src.Accounts()
+	if err != nil {
+		if sel.Source != USER_SOURCE_UTMPX {
+			return nil, err
+		}
+		GLog.Warnf("Can not read login classes of users : %v", err)
+	}
+	known := accountsByUid(accounts)
+	if sel.Source == USER_SOURCE_UTMPX || sel.Source == USER_SOURCE_ALL {
+		usrs, err := src.Users()
+		if err != nil {
+			return nil, err
+		}
+		for _, usr := range usrs {
+			usr.Class = known[usr.Uid].Class
+			byUid[usr.Uid] = usr
+		}
+	}
+	if sel.Source == USER_SOURCE_PASSWD || sel.Source == USER_SOURCE_ALL {
+		for uid, usr := range known {
+			byUid[uid] = usr
+		}
+	}
+
+	if sel.Source == USER_SOURCE_PROCESS || sel.Source == USER_SOURCE_ALL {
+		procs, err := src.Processes()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range procs {
+			if _, ok := byUid[p.Uid]; ok {
+				continue
+			}
+			// Owner without account is named by its UID, as ps(1) does
+			usr, ok := known[p.Uid]
+			if !ok {
+				usr = User{Name: strconv.Itoa(p.Uid), Uid: p.Uid}
+			}
+			byUid[p.Uid] = usr
+		}
+	}
+
+	usrs := make([]User, 0, len(byUid))
+	for uid, usr := range byUid {
+		if uid < sel.UidMin || (sel.UidMax >= 0 && uid > sel.UidMax) {
+			continue
+		}
+		usrs = append(usrs, usr)
+	}
+	sort.Slice(usrs, func(i, j int) bool { return usrs[i].Uid < usrs[j].Uid })
+
+	return usrs, nil
+}
+
+// Returns the first account of each UID. Accounts sharing a UID, like root and toor, are named after
+// the first one in the password database, as getpwuid(3) does.
+func accountsByUid(accounts []User) map[int]User {
+	byUid := make(map[int]User)
+
+	for _, usr := range accounts {
+		if _, ok := byUid[usr.Uid]; !ok {
+			byUid[usr.Uid] = usr
+		}
+	}
+
+	return byUid
+}
+
+func isUserSource(source string) bool {
+	for _, v := range USER_SOURCES {
+		if v == source {
+			return true
+		}
+	}
+	return false
+}
+
+// get users from a passwd(5) file. master.passwd entries also have the login class.
+func getUsersFromPasswd(file string) ([]User, error) {
+	var usrs []User
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return usrs, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// name:password:uid:gid:gecos:home:shell
+		// or name:password:uid:gid:class:change:expire:gecos:home:shell in master.passwd
+		s := strings.Split(line, ":")
+		if len(s) < 3 || len(s[0]) == 0 {
+			continue
+		}
+		uid, err := strconv.Atoi(s[2])
+		if err != nil {
+			// NIS "+" entries have no UID
+			continue
+		}
+		usr := User{Name: s[0], Uid: uid}
+		if len(s) == 10 {
+			// Users without class get the default one, as login_getpwclass(3) does
+			usr.Class = s[4]
+			if len(usr.Class) == 0 {
+				usr.Class = "default"
+			}
+		}
+		GLog.Debug("Appending user " + usr.Name + " with UID " + strconv.Itoa(usr.Uid))
+		usrs = append(usrs, usr)
+	}
+
+	return usrs, nil
+}
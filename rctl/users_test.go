@@ -0,0 +1,41 @@
+package rctl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListUsers(t *testing.T) {
+	f := NewFakeSource()
+	f.AccountList = []User{{Name: "root", Uid: 0, Class: "daemon"}, {Name: "toor", Uid: 0, Class: "default"},
+		{Name: "www", Uid: 80, Class: "default"}, {Name: "alice", Uid: 1001, Class: "staff"}}
+	f.UserList = []User{{Name: "alice", Uid: 1001}}
+	f.ProcessList = []Process{{Pid: 1, Uid: 0}, {Pid: 10, Uid: 80}, {Pid: 11, Uid: 1002}}
+
+	tests := []struct {
+		sel  UserSelection
+		want []User
+	}{
+		{UserSelection{Source: USER_SOURCE_UTMPX, UidMax: -1},
+			[]User{{Name: "alice", Uid: 1001, Class: "staff"}}},
+		{UserSelection{Source: USER_SOURCE_PASSWD, UidMax: -1},
+			[]User{{Name: "root", Uid: 0, Class: "daemon"}, {Name: "www", Uid: 80, Class: "default"},
+				{Name: "alice", Uid: 1001, Class: "staff"}}},
+		{UserSelection{Source: USER_SOURCE_PROCESS, UidMax: -1},
+			[]User{{Name: "root", Uid: 0, Class: "daemon"}, {Name: "www", Uid: 80, Class: "default"},
+				{Name: "1002", Uid: 1002}}},
+		{UserSelection{Source: USER_SOURCE_ALL, UidMin: 80, UidMax: 1001},
+			[]User{{Name: "www", Uid: 80, Class: "default"}, {Name: "alice", Uid: 1001, Class: "staff"}}},
+	}
+
+	for _, tt := range tests {
+		got, err := listUsers(f, tt.sel)
+		if err != nil {
+			t.Errorf("%+v : unexpected error %v", tt.sel, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v : got %+v, want %+v", tt.sel, got, tt.want)
+		}
+	}
+}
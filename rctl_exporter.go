@@ -1,13 +1,14 @@
 // Copyright 2020, johan@nosd.in
-// +build freebsd
 
 // Inspired from dovecot_exporter and https://blog.skyrise.tech/custom-prometheus-exporter
 
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
-	"strings"
+	"strconv"
 	"net/http"
 	// For profiling, to fix these memory leaks. This is the only required instruction
 	//  required to enable profiling on the already included web server !
@@ -17,6 +18,7 @@ import (
 	"github.com/alecthomas/kingpin"
 	"github.com/yo000/rctl_exporter/rctl"
 	"github.com/yo000/rctl_exporter/collector"
+	"github.com/yo000/rctl_exporter/config"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"	
 )
@@ -28,33 +30,99 @@ var (
 //var rctlCollect = []string{"process:.*", "user:^yo$", "jail:ioc-testarp", "loginclass:.*"}
 
 func main() {
-	var results []rctl.Resource
 	var (
 		app            = kingpin.New("rctl_exporter", "Prometheus metrics exporter for rctl")
 		listenAddress  = app.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9767").String()
 		metricsPath    = app.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-		rctlCollectArg = app.Flag("rctl.filter", "Filter for rctl collection. Ex: \"process:.*java.*,user:git\"").Default("user:.*").String()
+		configFile     = app.Flag("config.file", "YAML configuration file. When set, rctl.* flags are ignored, except rctl.filter whose filters are added to the file ones").String()
+		rctlCollectArg = app.Flag("rctl.filter", "Filter for rctl collection, \"user:.*\" without configuration file. Ex: \"process:.*java.*,user:git\" or \"process:jail=web01,exe=nginx\"").String()
+		rctlInterval   = app.Flag("rctl.refresh-interval", "Refresh usage in background at this interval, instead of at each scrape. 0 disables background refresh").Default("0s").Duration()
+		rctlWorkers    = app.Flag("rctl.workers", "Number of concurrent rctl lookups during a refresh").Default(strconv.Itoa(rctl.DEFAULT_WORKERS)).Int()
+		rctlLimits     = app.Flag("rctl.limits", "Also export rctl rules applying to collected items. Processes limits take one more syscall per process, disable with --no-rctl.limits").Default("true").Bool()
+		rctlJailRollup = app.Flag("rctl.jail-rollup", "Also export usage of ancestors of collected jails, which includes all their children, as rctl_usage_jail_rollup_*").Bool()
+		rctlUserSource = app.Flag("rctl.user-source", "Where users collected by user filters are enumerated from : utmpx sessions, passwd database, owners of running processes, or all").Default(rctl.USER_SOURCE_UTMPX).Enum(rctl.USER_SOURCES...)
+		rctlUidMin     = app.Flag("rctl.user-uid-min", "Do not collect users with a lower UID").Default("0").Int()
+		rctlUidMax     = app.Flag("rctl.user-uid-max", "Do not collect users with a greater UID, -1 for no limit").Default("-1").Int()
+		rctlProcGroups = app.Flag("rctl.procgroup", "Sum usage of processes in a named group, e.g. \"postgres: exe=postgres\" or \"java-apps: cmdline=~-jar \\S+\". Repeatable").Strings()
+		legacyNames    = app.Flag("compat.legacy-names", "Also export metrics with their names from before units were added, like rctl_usage_jail_memoryuse, during migration").Bool()
 		debug         = app.Flag("debug", "Enable debug mode").Bool()
+
+		serveCmd       = app.Command("serve", "Run the exporter (default)").Default()
+		checkRulesCmd  = app.Command("check-rules", "Check a rctl.conf file then exit")
+		checkRulesFile = checkRulesCmd.Arg("file", "rctl.conf file to check").Default("/etc/rctl.conf").String()
 	)
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	if *debug == true {
 		log.SetLevel(logrus.DebugLevel)
 	}
 
-	rctlCollect := strings.Split(*rctlCollectArg, ",")
+	switch cmd {
+	case checkRulesCmd.FullCommand():
+		os.Exit(checkRules(*checkRulesFile))
+	case serveCmd.FullCommand():
+		// Run the exporter below
+	}
 
-	rmgr, err := rctl.NewResourceManager(rctlCollect, log)
-	if err != nil {
-		log.Error("Error getting resources : %d", err)
+	// Without configuration file, flags are the configuration. Reloads call it again.
+	loadConfig := func() (config.Config, error) {
+		cfg := config.Default()
+		filterArg := *rctlCollectArg
+		if len(*configFile) > 0 {
+			var err error
+			cfg, err = config.Load(*configFile)
+			if err != nil {
+				return cfg, err
+			}
+		} else {
+			cfg.RefreshInterval = *rctlInterval
+			cfg.Workers = *rctlWorkers
+			cfg.Limits = *rctlLimits
+			cfg.Jail.Rollup = *rctlJailRollup
+			cfg.User.Source, cfg.User.UidMin, cfg.User.UidMax = *rctlUserSource, *rctlUidMin, *rctlUidMax
+			for _, def := range *rctlProcGroups {
+				g, err := rctl.ParseProcGroup(def)
+				if err != nil {
+					return cfg, err
+				}
+				cfg.ProcGroups = append(cfg.ProcGroups, procGroupConfig(g))
+			}
+			if len(filterArg) == 0 {
+				filterArg = "user:.*"
+			}
+		}
+		if len(filterArg) > 0 {
+			cfg.Filters = append(cfg.Filters, rctl.SplitFilters(filterArg)...)
+		}
+		if *legacyNames {
+			cfg.Compat.LegacyNames = true
+		}
+		return cfg, cfg.Validate()
 	}
-	for _, r := range rmgr.Resources {
-		results = append(results, r)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Error loading configuration : %v", err)
 	}
 
+	rmgr, err := rctl.NewResourceManager(cfg.AllFilters(), rctl.NewSyscallSource(), log)
+	if err != nil {
+		log.Fatalf("Error creating resource manager : %v", err)
+	}
 	coll := collector.New(rmgr, log)
+	if err := applyConfig(rmgr, coll, cfg); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cfg.RefreshInterval > 0 {
+		rmgr.Start(context.Background(), cfg.RefreshInterval)
+	}
 	prometheus.MustRegister(coll)
 
+	rl := newReloader(loadConfig, rmgr, coll, cfg.RefreshInterval)
+	prometheus.MustRegister(rl.success, rl.timestamp)
+	go rl.watchSignals()
+	http.HandleFunc("/-/reload", rl.ServeHTTP)
+
 	http.Handle(*metricsPath, promhttp.Handler())
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`
@@ -68,3 +136,68 @@ func main() {
 	})
 	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
+
+// Sets filters and options of the manager and the collector from the configuration
+func applyConfig(rmgr *rctl.ResourceMgr, coll *collector.Collector, cfg config.Config) error {
+	procGroups, err := cfg.ProcessGroups()
+	if err != nil {
+		return err
+	}
+
+	err = rmgr.Reconfigure(cfg.AllFilters(), func(m *rctl.ResourceMgr) {
+		m.Workers = cfg.Workers
+		m.Limits = cfg.Limits
+		m.JailRollup = cfg.Jail.Rollup
+		m.ProcGroups = procGroups
+		m.Users = cfg.UserSelection()
+	})
+	if err != nil {
+		return err
+	}
+	coll.SetOptions(collector.Options{
+		Resources:   cfg.ResourceNames(),
+		NoCmdLine:   !cfg.Labels.Cmdline,
+		NoCaptures:  !cfg.Labels.Captures,
+		LegacyNames: cfg.Compat.LegacyNames,
+	})
+
+	return nil
+}
+
+// Returns the configuration file equivalent of a --rctl.procgroup flag
+func procGroupConfig(g rctl.ProcGroup) config.ProcGroupConfig {
+	value := g.Value
+	if g.Regexp != nil {
+		value = "~" + value
+	}
+	if g.Field == "cmdline" {
+		return config.ProcGroupConfig{Name: g.Name, Cmdline: value}
+	}
+	return config.ProcGroupConfig{Name: g.Name, Exe: value}
+}
+
+// Check rctl.conf file, print problems found and return exit status
+func checkRules(file string) int {
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+	defer f.Close()
+
+	rules, problems, err := rctl.CheckRules(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, err)
+		return 2
+	}
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", file, p.Line, p.Msg)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d problem(s) found\n", file, len(problems))
+		return 1
+	}
+
+	fmt.Printf("%s: %d rule(s) OK\n", file, len(rules))
+	return 0
+}
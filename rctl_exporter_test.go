@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckRulesExitCode(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	tests := []struct {
+		file string
+		want int
+	}{
+		{write("valid.conf", "# comment\nuser:1001:memoryuse:deny=1g\njail:www:pcpu:throttle=50\n"), 0},
+		{write("empty.conf", ""), 0},
+		{write("invalid.conf", "user:1001:memoryuse:deny=1g\njail:www:cputime:deny=1\n"), 1},
+		{write("conflict.conf", "user:1001:memoryuse:deny=1g\nuser:1001:memoryuse:deny=2g\n"), 1},
+		{filepath.Join(dir, "missing.conf"), 2},
+	}
+
+	for _, tt := range tests {
+		if got := checkRules(tt.file); got != tt.want {
+			t.Errorf("checkRules(%s) = %d, want %d", filepath.Base(tt.file), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2020, johan@nosd.in
+
+// Reload configuration on SIGHUP and POST /-/reload, without losing the running state
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yo000/rctl_exporter/collector"
+	"github.com/yo000/rctl_exporter/config"
+	"github.com/yo000/rctl_exporter/rctl"
+)
+
+type reloader struct {
+	mu        sync.Mutex // Serializes reloads
+	load      func() (config.Config, error)
+	rmgr      *rctl.ResourceMgr
+	coll      *collector.Collector
+	interval  time.Duration // Background refresh interval set at startup, a reload can not change it
+	success   prometheus.Gauge
+	timestamp prometheus.Gauge
+}
+
+func newReloader(load func() (config.Config, error), rmgr *rctl.ResourceMgr, coll *collector.Collector, interval time.Duration) *reloader {
+	rl := &reloader{
+		load:     load,
+		rmgr:     rmgr,
+		coll:     coll,
+		interval: interval,
+		success: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "rctl_exporter_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful",
+		}),
+		timestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "rctl_exporter_config_last_reload_success_timestamp_seconds",
+			Help: "Time of the last successful configuration reload",
+		}),
+	}
+	// Configuration was loaded at startup
+	rl.success.Set(1)
+	rl.timestamp.SetToCurrentTime()
+
+	return rl
+}
+
+// Loads the configuration again and applies it. When it is invalid, the previous configuration is kept.
+func (rl *reloader) reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cfg, err := rl.load()
+	if err == nil {
+		err = applyConfig(rl.rmgr, rl.coll, cfg)
+	}
+	if err != nil {
+		rl.success.Set(0)
+		log.Errorf("Error reloading configuration, keeping the previous one : %v", err)
+		return err
+	}
+
+	if cfg.RefreshInterval != rl.interval {
+		log.Warnf("Refresh interval changed from %v to %v, it is only applied on restart", rl.interval, cfg.RefreshInterval)
+	}
+	rl.success.Set(1)
+	rl.timestamp.SetToCurrentTime()
+	log.Info("Configuration reloaded")
+
+	return nil
+}
+
+// Reloads on each SIGHUP
+func (rl *reloader) watchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		rl.reload()
+	}
+}
+
+// Reloads on POST /-/reload, replies with the error if the configuration is invalid
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "This endpoint requires a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := rl.reload(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		return
+	}
+}
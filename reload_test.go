@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/yo000/rctl_exporter/collector"
+	"github.com/yo000/rctl_exporter/config"
+	"github.com/yo000/rctl_exporter/rctl"
+)
+
+// Returns a reloader loading *cfg, or failing with *loadErr
+func testReloader(t *testing.T, cfg *config.Config, loadErr *error) (*reloader, *rctl.ResourceMgr) {
+	f := rctl.NewFakeSource()
+	f.JailList = []rctl.Jail{{Name: "www", Jid: 1}, {Name: "db", Jid: 2}}
+	f.Usage["jail:www"] = "cputime=1"
+	f.Usage["jail:db"] = "cputime=2"
+
+	rmgr, err := rctl.NewResourceManager(cfg.AllFilters(), f, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := collector.New(rmgr, logrus.New())
+	if err := applyConfig(rmgr, coll, *cfg); err != nil {
+		t.Fatal(err)
+	}
+	load := func() (config.Config, error) {
+		if *loadErr != nil {
+			return *cfg, *loadErr
+		}
+		return *cfg, cfg.Validate()
+	}
+
+	return newReloader(load, rmgr, coll, 0), rmgr
+}
+
+// Returns names of collected jails
+func collectedJails(t *testing.T, rmgr *rctl.ResourceMgr) []string {
+	var names []string
+
+	snap, err := rmgr.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range snap.Resources {
+		names = append(names, r.JailName)
+	}
+
+	return names
+}
+
+func reloadSuccessful(t *testing.T, rl *reloader) float64 {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(rl.success)
+	mfs, err := reg.Gather()
+	if err != nil || len(mfs) != 1 {
+		t.Fatalf("got %v, error %v", mfs, err)
+	}
+	return mfs[0].GetMetric()[0].GetGauge().GetValue()
+}
+
+func TestReload(t *testing.T) {
+	var loadErr error
+	cfg := config.Default()
+	cfg.Filters = []string{"jail:^www$"}
+	rl, rmgr := testReloader(t, &cfg, &loadErr)
+
+	if got := collectedJails(t, rmgr); !reflect.DeepEqual(got, []string{"www"}) {
+		t.Fatalf("got jails %v, want [www]", got)
+	}
+
+	// A valid configuration replaces the filters
+	cfg.Filters = []string{"jail:.*"}
+	if err := rl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := collectedJails(t, rmgr); !reflect.DeepEqual(got, []string{"www", "db"}) {
+		t.Errorf("got jails %v, want [www db]", got)
+	}
+	if v := reloadSuccessful(t, rl); v != 1 {
+		t.Errorf("got reload successful %v, want 1", v)
+	}
+
+	// An invalid one is not applied
+	cfg.Filters = []string{"jail:^db$", "jail:("}
+	if err := rl.reload(); err == nil {
+		t.Error("want an error for an invalid filter")
+	}
+	if got := collectedJails(t, rmgr); !reflect.DeepEqual(got, []string{"www", "db"}) {
+		t.Errorf("got jails %v, want the previous filters", got)
+	}
+	if v := reloadSuccessful(t, rl); v != 0 {
+		t.Errorf("got reload successful %v, want 0", v)
+	}
+
+	// Nor one which can not be read
+	cfg.Filters = []string{"jail:^db$"}
+	loadErr = errors.New("permission denied")
+	if err := rl.reload(); err == nil {
+		t.Error("want an error for an unreadable file")
+	}
+	if got := collectedJails(t, rmgr); len(got) != 2 {
+		t.Errorf("got jails %v, want the previous filters", got)
+	}
+
+	loadErr = nil
+	if err := rl.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if v := reloadSuccessful(t, rl); v != 1 {
+		t.Errorf("got reload successful %v, want 1", v)
+	}
+}
+
+func TestReloadHTTP(t *testing.T) {
+	var loadErr error
+	cfg := config.Default()
+	cfg.Filters = []string{"jail:^www$"}
+	rl, rmgr := testReloader(t, &cfg, &loadErr)
+
+	tests := []struct {
+		method  string
+		filters []string
+		status  int
+		jails   []string
+	}{
+		{http.MethodGet, []string{"jail:.*"}, http.StatusMethodNotAllowed, []string{"www"}},
+		{http.MethodPut, []string{"jail:.*"}, http.StatusMethodNotAllowed, []string{"www"}},
+		{http.MethodPost, []string{"jail:("}, http.StatusInternalServerError, []string{"www"}},
+		{http.MethodPost, []string{"jail:^db$"}, http.StatusOK, []string{"db"}},
+	}
+
+	for _, tt := range tests {
+		cfg.Filters = tt.filters
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, httptest.NewRequest(tt.method, "/-/reload", nil))
+		if w.Code != tt.status {
+			t.Errorf("%s %v : got status %d, want %d", tt.method, tt.filters, w.Code, tt.status)
+		}
+		if tt.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") != http.MethodPost {
+			t.Errorf("%s : got Allow %q, want POST", tt.method, w.Header().Get("Allow"))
+		}
+		if got := collectedJails(t, rmgr); !reflect.DeepEqual(got, tt.jails) {
+			t.Errorf("%s %v : got jails %v, want %v", tt.method, tt.filters, got, tt.jails)
+		}
+	}
+}